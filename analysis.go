@@ -0,0 +1,176 @@
+package gosafe
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/copylock"
+	"golang.org/x/tools/go/analysis/passes/lostcancel"
+	"golang.org/x/tools/go/analysis/passes/printf"
+	"golang.org/x/tools/go/analysis/passes/unreachable"
+	"os"
+	"reflect"
+)
+
+// VetAnalyzers are the go vet analyzers most useful for code submitted to a Compiler, to enable with Compiler.EnableAnalyzer.
+var VetAnalyzers = []*analysis.Analyzer{
+	printf.Analyzer,
+	unreachable.Analyzer,
+	copylock.Analyzer,
+	lostcancel.Analyzer,
+}
+
+// EnableAnalyzer will make Check run analyzer on the type checked code, and return its diagnostics as AnalyzerFinding violations
+// with the given severity. Enabling an analyzer again changes its severity.
+// Analyzers only get the facts of the checked code itself, not of the packages it imports.
+func (self *Compiler) EnableAnalyzer(analyzer *analysis.Analyzer, severity Severity) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.analyzers[analyzer] = severity
+}
+
+type objectFactKey struct {
+	obj      types.Object
+	factType reflect.Type
+}
+
+type packageFactKey struct {
+	pkg      *types.Package
+	factType reflect.Type
+}
+
+// analysisRun runs analyzers on one type checked package, sharing the results of required analyzers and the facts they export.
+type analysisRun struct {
+	compiler     *Compiler
+	fset         *token.FileSet
+	files        []*ast.File
+	pkg          *types.Package
+	info         *types.Info
+	typeErrors   []types.Error
+	sources      map[string][]byte
+	results      map[*analysis.Analyzer]interface{}
+	errors       map[*analysis.Analyzer]error
+	objectFacts  map[objectFactKey]analysis.Fact
+	packageFacts map[packageFactKey]analysis.Fact
+	violations   []Violation
+}
+
+// run returns the result of running analyzer, and all analyzers it requires, on the package of this analysisRun.
+// Diagnostics of enabled analyzers become violations.
+func (self *analysisRun) run(analyzer *analysis.Analyzer) (interface{}, error) {
+	if result, done := self.results[analyzer]; done {
+		return result, self.errors[analyzer]
+	}
+	resultOf := make(map[*analysis.Analyzer]interface{})
+	for _, required := range analyzer.Requires {
+		result, err := self.run(required)
+		if err != nil {
+			return nil, err
+		}
+		resultOf[required] = result
+	}
+	checked := make(map[string]bool)
+	for _, file := range self.files {
+		checked[self.fset.File(file.Pos()).Name()] = true
+	}
+	pass := &analysis.Pass{
+		Analyzer:   analyzer,
+		Fset:       self.fset,
+		Files:      self.files,
+		Pkg:        self.pkg,
+		TypesInfo:  self.info,
+		TypesSizes: types.SizesFor("gc", self.compiler.GOARCH),
+		TypeErrors: self.typeErrors,
+		ResultOf:   resultOf,
+		Report: func(diagnostic analysis.Diagnostic) {
+			if severity, enabled := self.compiler.analyzers[analyzer]; enabled {
+				self.violations = append(self.violations, Violation{
+					Pos:      self.fset.Position(diagnostic.Pos),
+					Kind:     AnalyzerFinding,
+					Message:  diagnostic.Message,
+					Rule:     analyzer.Name,
+					Severity: severity,
+				})
+			}
+		},
+		ReadFile: func(filename string) ([]byte, error) {
+			// Analyzers may only read the checked files
+			if !checked[filename] {
+				return nil, os.ErrPermission
+			}
+			return self.sources[filename], nil
+		},
+		ImportObjectFact: func(obj types.Object, fact analysis.Fact) bool {
+			if found, ok := self.objectFacts[objectFactKey{obj, reflect.TypeOf(fact)}]; ok {
+				reflect.ValueOf(fact).Elem().Set(reflect.ValueOf(found).Elem())
+				return true
+			}
+			return false
+		},
+		ImportPackageFact: func(pkg *types.Package, fact analysis.Fact) bool {
+			if found, ok := self.packageFacts[packageFactKey{pkg, reflect.TypeOf(fact)}]; ok {
+				reflect.ValueOf(fact).Elem().Set(reflect.ValueOf(found).Elem())
+				return true
+			}
+			return false
+		},
+		ExportObjectFact: func(obj types.Object, fact analysis.Fact) {
+			self.objectFacts[objectFactKey{obj, reflect.TypeOf(fact)}] = fact
+		},
+		ExportPackageFact: func(fact analysis.Fact) {
+			self.packageFacts[packageFactKey{self.pkg, reflect.TypeOf(fact)}] = fact
+		},
+		AllObjectFacts: func() (rval []analysis.ObjectFact) {
+			for key, fact := range self.objectFacts {
+				rval = append(rval, analysis.ObjectFact{Object: key.obj, Fact: fact})
+			}
+			return rval
+		},
+		AllPackageFacts: func() (rval []analysis.PackageFact) {
+			for key, fact := range self.packageFacts {
+				rval = append(rval, analysis.PackageFact{Package: key.pkg, Fact: fact})
+			}
+			return rval
+		},
+	}
+	var result interface{}
+	var err error
+	if len(self.typeErrors) == 0 || analyzer.RunDespiteErrors {
+		result, err = analyzer.Run(pass)
+	}
+	self.results[analyzer] = result
+	self.errors[analyzer] = err
+	return result, err
+}
+
+// checkAnalyzers returns violations for the diagnostics of the analyzers enabled in this gosafe.Compiler, when run on the type checked package pkg.
+// sources are the contents of the checked files.
+func (self *Compiler) checkAnalyzers(fset *token.FileSet, files []*ast.File, pkg *types.Package, info *types.Info, typeErrors []types.Error, sources map[string][]byte) []Violation {
+	run := &analysisRun{
+		compiler:     self,
+		fset:         fset,
+		files:        files,
+		pkg:          pkg,
+		info:         info,
+		typeErrors:   typeErrors,
+		sources:      sources,
+		results:      make(map[*analysis.Analyzer]interface{}),
+		errors:       make(map[*analysis.Analyzer]error),
+		objectFacts:  make(map[objectFactKey]analysis.Fact),
+		packageFacts: make(map[packageFactKey]analysis.Fact),
+	}
+	for analyzer, severity := range self.analyzers {
+		if _, err := run.run(analyzer); err != nil {
+			run.violations = append(run.violations, Violation{
+				Pos:      fset.Position(files[0].Pos()),
+				Kind:     AnalyzerFinding,
+				Message:  fmt.Sprintf("Analyzer %v failed: %v", analyzer.Name, err),
+				Rule:     analyzer.Name,
+				Severity: severity,
+			})
+		}
+	}
+	return run.violations
+}
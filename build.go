@@ -0,0 +1,276 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// DefaultBuildTimeout is the BuildTimeout of new Compilers.
+const DefaultBuildTimeout = time.Minute * 5
+
+// ErrCompileLimit is returned, wrapped, when the go toolchain hits the BuildTimeout, BuildMemory or BuildCPU limit of a Compiler.
+// Use errors.Is to detect it.
+const ErrCompileLimit = Error("Compile limit exceeded")
+
+// defaultBuildCache returns the private go build cache directory of new Compilers, so that checked code never shares a cache with the
+// user running gosafe.
+func defaultBuildCache() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "gosafe", "go-build")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprint("gosafe-go-build-", os.Getuid()))
+}
+
+// defaultModCache returns the private module cache directory of new Compilers.
+func defaultModCache() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "gosafe", "mod")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprint("gosafe-mod-", os.Getuid()))
+}
+
+// BuildResult describes a binary built by a Compiler.
+type BuildResult struct {
+	// Output is the path of the binary.
+	Output string
+	// Env is the complete environment the go toolchain built the binary with, or would have built it with if it was cached.
+	Env []string
+	// Cached is whether the binary was taken from a cache instead of being built.
+	Cached bool
+	// Toolchain is the version of the go toolchain the binary was built with, like "go1.21.3".
+	Toolchain string
+	// Warnings are the violations with Warning severity found when checking the code.
+	Warnings []Violation
+}
+
+// toolchainEnv returns the environment variables deciding how the go toolchain builds code with options, the same for every process running
+// this gosafe.Compiler with the same options. It forces module mode, ignores the go env file of the user, disables cgo, never switches toolchain
+// and makes sure the network is never contacted.
+func (self *Compiler) toolchainEnv(options BuildOptions) []string {
+	return append([]string{
+		"CGO_ENABLED=0",
+		"GO111MODULE=on",
+		"GOENV=off",
+		"GOFLAGS=-mod=mod",
+		"GOPROXY=off",
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+		"GOWORK=off",
+		fmt.Sprint("GOOS=", self.GOOS),
+		fmt.Sprint("GOARCH=", self.GOARCH),
+	}, options.env()...)
+}
+
+// buildEnv returns the scrubbed environment to run the go toolchain with options inside the throwaway modules.
+// Only the variables needed to run the toolchain are inherited, the caches are the BuildCache and ModCache of this gosafe.Compiler, and the rest
+// is the toolchainEnv.
+func (self *Compiler) buildEnv(options BuildOptions) ([]string, error) {
+	for _, dir := range []string{self.BuildCache, self.ModCache} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	var rval []string
+	for _, name := range []string{"PATH", "HOME", "TMPDIR", "GOROOT", "SYSTEMROOT"} {
+		// Other toolchains find their own GOROOT
+		if name == "GOROOT" && self.Toolchain != "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			rval = append(rval, fmt.Sprint(name, "=", value))
+		}
+	}
+	rval = append(rval,
+		fmt.Sprint("GOCACHE=", self.BuildCache),
+		fmt.Sprint("GOMODCACHE=", self.ModCache),
+	)
+	return append(rval, self.toolchainEnv(options)...), nil
+}
+
+// runGo runs the go toolchain with args and the environment env, from buildEnv, in dir, inside the limits and sandbox of this gosafe.Compiler.
+// The toolchain is killed, with all its child processes, when ctx is done, and an error wrapping the error of ctx is returned.
+func (self *Compiler) runGo(ctx context.Context, dir string, env []string, stdout, stderr *bytes.Buffer, args ...string) (err error) {
+	limited := ctx
+	if self.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		limited, cancel = context.WithTimeout(ctx, self.BuildTimeout)
+		defer cancel()
+	}
+	binary, err := self.goBinary()
+	if err != nil {
+		return err
+	}
+	if err = self.acquireBuild(ctx); err != nil {
+		return fmt.Errorf("go %v not started: %w", args[0], err)
+	}
+	defer self.releaseBuild()
+	cmd := exec.CommandContext(limited, binary, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Don't wait forever for pipes held open by killed grandchildren
+	cmd.WaitDelay = time.Second
+	if err = self.sandbox(cmd); err != nil {
+		return err
+	}
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("go %v stopped: %w", args[0], ctx.Err())
+	}
+	if limited.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: go %v ran longer than BuildTimeout %v", ErrCompileLimit, args[0], self.BuildTimeout)
+	}
+	if err != nil && (self.BuildMemory > 0 || self.BuildCPU > 0) && limitHit(err, stderr.String()) {
+		return fmt.Errorf("%w: go %v hit BuildMemory %v or BuildCPU %v: %v", ErrCompileLimit, args[0], self.BuildMemory, self.BuildCPU, stderr.String())
+	}
+	return err
+}
+
+// acquireBuild waits until fewer than MaxBuilds go toolchain processes are running, and counts one more.
+// Returns the error of ctx, without counting, if ctx is done before that.
+func (self *Compiler) acquireBuild(ctx context.Context) error {
+	// Wake up the waiting below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		self.cacheLock.Lock()
+		defer self.cacheLock.Unlock()
+		self.buildDone.Broadcast()
+	})
+	defer stop()
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	for self.MaxBuilds > 0 && self.running >= self.MaxBuilds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		self.buildDone.Wait()
+	}
+	self.running++
+	return nil
+}
+
+// releaseBuild counts one go toolchain process less, and wakes up the ones waiting in acquireBuild.
+func (self *Compiler) releaseBuild() {
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	self.running--
+	self.buildDone.Broadcast()
+}
+
+// flight is a build of a binary shared by all concurrent compiles of the same source with the same policy.
+type flight struct {
+	done   chan struct{}
+	binary string
+	err    error
+	// the compiles waiting for or copying the binary
+	users int
+}
+
+// buildShared builds files, with the contents in sources, with options in the environment env to output, sharing one go build with all concurrent compiles with the same key.
+// Compiles waiting for a build stopped by the context of another compile start a new one.
+func (self *Compiler) buildShared(ctx context.Context, key string, files []string, sources map[string][]byte, options BuildOptions, env []string, output string) error {
+	progress(ctx, Building)
+	for {
+		self.cacheLock.Lock()
+		current, found := self.flights[key]
+		if !found {
+			current = &flight{done: make(chan struct{})}
+			self.flights[key] = current
+		}
+		current.users++
+		self.cacheLock.Unlock()
+		if found {
+			select {
+			case <-current.done:
+			case <-ctx.Done():
+				self.leave(key, current)
+				return ctx.Err()
+			}
+		} else {
+			current.binary, current.err = self.build(ctx, key, files, sources, options, env)
+			if current.err != nil {
+				// Let new compiles try again
+				self.cacheLock.Lock()
+				delete(self.flights, key)
+				self.cacheLock.Unlock()
+			}
+			close(current.done)
+		}
+		err := current.err
+		retry := found && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+		if err == nil {
+			err = copyBinary(current.binary, output)
+		}
+		self.leave(key, current)
+		if !retry {
+			return err
+		}
+	}
+}
+
+// leave stops using the shared build current of key, and removes it and its binary if it was the last user.
+func (self *Compiler) leave(key string, current *flight) {
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	if current.users--; current.users == 0 {
+		if self.flights[key] == current {
+			delete(self.flights, key)
+		}
+		if current.binary != "" {
+			os.Remove(current.binary)
+		}
+	}
+}
+
+// build builds files, with the contents in sources, with options in the environment env in a throwaway module, where all replaced packages are available, to a binary in the work
+// directory of this gosafe.Compiler, verifies it if VerifyBinary is set, and caches it under key in CacheDir.
+// Errors reported by the toolchain are returned as a *CompileError with the file names printed by the toolchain.
+func (self *Compiler) build(ctx context.Context, key string, files []string, sources map[string][]byte, options BuildOptions, env []string) (string, error) {
+	workDir, err := self.work()
+	if err != nil {
+		return "", err
+	}
+	binary := filepath.Join(workDir, fmt.Sprint(key, ".gosafe"))
+	dir, root, err := self.newModule(ctx, files, sources, self.Gas > 0, options.Lang)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(root)
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	args := append([]string{"build", "-o", binary}, options.args()...)
+	err = self.runGo(ctx, dir, env, &stdout, &stderr, append(args, ".")...)
+	if errors.Is(err, ErrCompileLimit) || ctx.Err() != nil {
+		return "", err
+	}
+	if diagnostics := parseDiagnostics(stderr.String()); len(diagnostics) > 0 {
+		return "", &CompileError{Diagnostics: diagnostics}
+	}
+	if stderr.Len() > 0 {
+		return "", Error(stderr.String())
+	}
+	if stdout.Len() > 0 {
+		return "", Error(stdout.String())
+	}
+	if err != nil {
+		return "", err
+	}
+	if self.VerifyBinary {
+		progress(ctx, Verifying)
+		if err = self.verifyBinary(ctx, binary, dir, env); err != nil {
+			os.Remove(binary)
+			return "", err
+		}
+	}
+	if err = self.storeCached(key, binary); err != nil {
+		os.Remove(binary)
+		return "", err
+	}
+	return binary, nil
+}
@@ -0,0 +1,269 @@
+package gosafe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCacheSize is the CacheSize of new Compilers.
+const DefaultCacheSize = 1 << 30
+
+// defaultCacheDir returns the CacheDir of new Compilers.
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "gosafe", "bin")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprint("gosafe-bin-", os.Getuid()))
+}
+
+// maxMemoryEntries is the largest number of entries in each in-memory cache of a Compiler.
+const maxMemoryEntries = 4096
+
+// makeRoom removes an arbitrary entry from cache if it has maxMemoryEntries, to make room for a new one.
+func makeRoom[V any](cache map[string]V) {
+	if len(cache) < maxMemoryEntries {
+		return
+	}
+	for key, _ := range cache {
+		delete(cache, key)
+		return
+	}
+}
+
+// writeField writes b to h prefixed with its length, so that consecutive fields can't be confused with each other.
+func writeField(h hash.Hash, b []byte) {
+	binary.Write(h, binary.BigEndian, int64(len(b)))
+	h.Write(b)
+}
+
+// fingerprint returns a deterministic description of the policy of this gosafe.Compiler, and everything else affecting how it checks and
+// builds code.
+func (self *Compiler) fingerprint() ([]byte, error) {
+	policy, err := json.Marshal(self.policy())
+	if err != nil {
+		return nil, err
+	}
+	var analyzers []string
+	for analyzer, severity := range self.analyzers {
+		analyzers = append(analyzers, fmt.Sprint(analyzer.Name, "=", severity))
+	}
+	sort.Strings(analyzers)
+	rules := make([]string, len(self.rules))
+	for index, rule := range self.rules {
+		rules[index] = fmt.Sprintf("%T", rule)
+	}
+	return []byte(fmt.Sprintf("%s\ngas=%v partial=%v\nanalyzers=%q\nrules=%q\nplatform=%v/%v", policy, self.Gas, self.PartialCheck, analyzers, rules, self.GOOS, self.GOARCH)), nil
+}
+
+// newDigest returns a hash already containing the fingerprint of this gosafe.Compiler and the toolchain version.
+func (self *Compiler) newDigest(ctx context.Context) (hash.Hash, error) {
+	fingerprint, err := self.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	version, err := self.toolchainVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rval := sha256.New()
+	writeField(rval, fingerprint)
+	writeField(rval, []byte(version))
+	return rval, nil
+}
+
+// checkKey returns the key to cache the result of checking files under: a digest of their names and contents in sources,
+// the BuildOptions the imported packages are type checked with, the fingerprint of this gosafe.Compiler and the toolchain version.
+func (self *Compiler) checkKey(ctx context.Context, files []string, sources map[string][]byte) (string, error) {
+	digest, err := self.newDigest(ctx)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(self.BuildOptions)
+	if err != nil {
+		return "", err
+	}
+	writeField(digest, encoded)
+	for _, file := range files {
+		writeField(digest, []byte(file))
+		writeField(digest, sources[file])
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// compileKey returns the key to cache the binary built from files with options under: a digest of their base names and contents in sources, the options,
+// the toolchainEnv, the source of all replaced packages, the fingerprint of this gosafe.Compiler and the toolchain version.
+func (self *Compiler) compileKey(ctx context.Context, files []string, sources map[string][]byte, options BuildOptions) (string, error) {
+	digest, err := self.newDigest(ctx)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	writeField(digest, encoded)
+	writeField(digest, []byte(strings.Join(self.toolchainEnv(options), "\n")))
+	for _, file := range files {
+		writeField(digest, []byte(filepath.Base(file)))
+		writeField(digest, sources[file])
+	}
+	if err = self.writeReplaced(digest); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// importKey returns the key to cache the export data of the packages imported by checked code under: a digest of the toolchain version, the
+// toolchainEnv and BuildOptions, and the source and trust of all replaced packages.
+func (self *Compiler) importKey(ctx context.Context) (string, error) {
+	version, err := self.toolchainVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.New()
+	writeField(digest, []byte(version))
+	encoded, err := json.Marshal(self.BuildOptions)
+	if err != nil {
+		return "", err
+	}
+	writeField(digest, encoded)
+	writeField(digest, []byte(strings.Join(self.toolchainEnv(self.BuildOptions), "\n")))
+	if err = self.writeReplaced(digest); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// writeReplaced writes the import paths, trust and source files of all replaced packages to h.
+func (self *Compiler) writeReplaced(h hash.Hash) error {
+	var paths []string
+	for p, _ := range self.replaced {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		_, trusted := matchAny(self.trusted, p)
+		writeField(h, []byte(fmt.Sprint(p, " trusted=", trusted)))
+		entries, err := ioutil.ReadDir(self.replaced[p])
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			src, err := ioutil.ReadFile(filepath.Join(self.replaced[p], entry.Name()))
+			if err != nil {
+				return err
+			}
+			writeField(h, []byte(entry.Name()))
+			writeField(h, src)
+		}
+	}
+	return nil
+}
+
+// copyBinary copies the executable src to dst through a temporary file, so that dst is replaced atomically even if it is running.
+func copyBinary(src, dst string) (err error) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".gosafe")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// loadCached copies the binary cached under key to output, if there is one, and returns whether there was.
+func (self *Compiler) loadCached(key, output string) (bool, error) {
+	if self.CacheDir == "" {
+		return false, nil
+	}
+	cached := filepath.Join(self.CacheDir, key)
+	if _, err := os.Stat(cached); err != nil {
+		return false, nil
+	}
+	if err := copyBinary(cached, output); err != nil {
+		return false, err
+	}
+	// The modification time is the last use, for the LRU eviction
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+	return true, nil
+}
+
+// storeCached caches the binary output under key, and evicts the least recently used binaries if the cache grows beyond CacheSize.
+func (self *Compiler) storeCached(key, output string) error {
+	if self.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(self.CacheDir, 0700); err != nil {
+		return err
+	}
+	if err := copyBinary(output, filepath.Join(self.CacheDir, key)); err != nil {
+		return err
+	}
+	return self.evict()
+}
+
+// evict removes the least recently used binaries from CacheDir until it is no bigger than CacheSize.
+func (self *Compiler) evict() error {
+	if self.CacheSize <= 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(self.CacheDir)
+	if err != nil {
+		return err
+	}
+	var binaries []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		// Leave temporary files of concurrent stores alone
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		binaries = append(binaries, entry)
+		size += entry.Size()
+	}
+	sort.Slice(binaries, func(i, j int) bool {
+		return binaries[i].ModTime().Before(binaries[j].ModTime())
+	})
+	for _, entry := range binaries {
+		if size <= self.CacheSize {
+			break
+		}
+		if err = os.Remove(filepath.Join(self.CacheDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= entry.Size()
+	}
+	return nil
+}
@@ -12,6 +12,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
 var stdin *json.Decoder
@@ -52,6 +55,74 @@ const UnknownResponseType = "Unknown response type: %+v"
 // BadResponseType is returned when the Response is of unexpected type.
 const BadResponseType = "Bad response type: %+v"
 
+// OutOfGas is returned when a Request takes more steps than allowed by the gosafe.Compiler that built the program.
+const OutOfGas = "Out of gas: took more than %v steps"
+
+var gas int64
+var gasLimit int64
+
+// responding guards writing Responses to Stdout, so that a goroutine running out of gas can respond to the Request being handled.
+var responding sync.Mutex
+// handling is whether a Server is handling a Request without having responded yet. Guarded by responding.
+var handling bool
+
+// callSafeName is the name of the function running Services, found in the stacks of the goroutines handling Requests.
+const callSafeName = "github.com/zond/gosafe/child.Service.callSafe"
+
+// setGas sets the number of steps each Request handled by a Server may take, where every call to Step is a step.
+// Programs built by a gosafe.Compiler with Gas are instrumented to call Step, and get a file in their copy of this package calling setGas
+// before they start. It is unexported so that the programs can't change their own gas.
+func setGas(steps int64) {
+	atomic.StoreInt64(&gasLimit, steps)
+	atomic.StoreInt64(&gas, steps)
+}
+
+// Step spends one step of gas. When there is none left it panics with OutOfGas in goroutines handling a Request, where the Server recovers it.
+// In other goroutines, like the ones started by a Request, nothing would recover it, so the Request being handled gets OutOfGas as its
+// Response and the process exits instead.
+// Only the instrumentation of a gosafe.Compiler with Gas may call it.
+func Step() {
+	if atomic.AddInt64(&gas, -1) < 0 {
+		if limit := atomic.LoadInt64(&gasLimit); limit > 0 {
+			message := fmt.Sprintf(OutOfGas, limit)
+			if !inService() {
+				exit(message)
+			}
+			panic(message)
+		}
+	}
+}
+
+// inService returns whether the calling goroutine is running a Service for a Server handling a Request.
+func inService() bool {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	for n == len(pcs) {
+		pcs = make([]uintptr, len(pcs)*2)
+		n = runtime.Callers(2, pcs)
+	}
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == callSafeName {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// exit responds to the Request being handled, if any, with an Error containing message, and exits the process.
+func exit(message string) {
+	responding.Lock()
+	if handling {
+		stdout.Encode(Response{Error, message})
+	}
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(2)
+}
+
 // Args is a shorthand for the array of interfaces used as arguments
 type Args []interface{}
 
@@ -100,7 +171,7 @@ func (self Server) Handle(c Request) Response {
 		if rval, err := service.callSafe(c.Args...); err == nil {
 			return Response{Return, rval}
 		} else {
-			return Response{Error, err}
+			return Response{Error, err.Error()}
 		}
 	}
 	return Response{Error, fmt.Sprintf(NoSuchService, c.Name)}
@@ -114,7 +185,7 @@ func (self Server) serve(c chan bool) {
 	for {
 		var call Request
 		if err := stdin.Decode(&call); err == nil {
-			stdout.Encode(self.Handle(call))
+			self.respond(call)
 		} else {
 			if err == io.EOF {
 				break
@@ -125,13 +196,34 @@ func (self Server) serve(c chan bool) {
 	}
 }
 
+// respond handles c with a full tank of gas, and responds to it.
+// With gas, goroutines still running when c has been handled would spend the gas of the next Request, so the process exits after responding.
+func (self Server) respond(c Request) {
+	goroutines := runtime.NumGoroutine()
+	atomic.StoreInt64(&gas, atomic.LoadInt64(&gasLimit))
+	responding.Lock()
+	handling = true
+	responding.Unlock()
+	response := self.Handle(c)
+	responding.Lock()
+	handling = false
+	stdout.Encode(response)
+	responding.Unlock()
+	if atomic.LoadInt64(&gasLimit) > 0 && runtime.NumGoroutine() > goroutines {
+		os.Exit(0)
+	}
+}
+
 // Call sends a request through Stdout to the parent process and returns the response.
 // The parent process has to have gosafe.Cmd#Register'ed the name used 
 func Call(name string, args... interface{}) (rval interface{}, err error) {
 	if stdin == nil || stdout == nil {
 		panic("You can't make callbacks if you haven't initialized Stdin() and Stdout()!")
 	}
-	if err := stdout.Encode(Response{Callback, Request{name, args}}); err != nil {
+	responding.Lock()
+	err = stdout.Encode(Response{Callback, Request{name, args}})
+	responding.Unlock()
+	if err != nil {
 		return nil, err
 	}
 	response := Response{}
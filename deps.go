@@ -0,0 +1,116 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+)
+
+// listedPackage is the subset of the `go list -json` output used when verifying dependencies.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	Imports    []string
+	ImportMap  map[string]string
+	Error      *struct {
+		Err string
+	}
+}
+
+// listDeps returns the packages in the transitive import closure of the package in the throwaway module dir, as reported by `go list -deps -json`.
+// The package itself is the last package returned.
+func (self *Compiler) listDeps(ctx context.Context, dir string) (rval []listedPackage, err error) {
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	env, err := self.buildEnv(BuildOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err = self.runGo(ctx, dir, env, &stdout, &stderr, "list", "-deps", "-json", "."); err != nil {
+		if stderr.Len() > 0 && !errors.Is(err, ErrCompileLimit) && ctx.Err() == nil {
+			return nil, Error(stderr.String())
+		}
+		return nil, err
+	}
+	decoder := json.NewDecoder(&stdout)
+	for {
+		var pkg listedPackage
+		if err = decoder.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if pkg.Error != nil {
+			return nil, Error(pkg.Error.Err)
+		}
+		rval = append(rval, pkg)
+	}
+	return rval, nil
+}
+
+// checkDeps returns violations for all non standard library packages in the transitive import closure of the program in files, with the contents
+// in sources, that import packages not allowed by this gosafe.Compiler.
+// Trusted packages may import anything not denied, while other packages must only import allowed packages.
+func (self *Compiler) checkDeps(ctx context.Context, files []string, sources map[string][]byte) (violations []Violation, err error) {
+	dir, root, err := self.newModule(ctx, files, sources, false, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+	pkgs, err := self.listDeps(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	// The import paths used in the source, for packages that go list reports under another path (like relative imports)
+	sourcePaths := make(map[string]string)
+	for _, pkg := range pkgs {
+		for source, resolved := range pkg.ImportMap {
+			sourcePaths[resolved] = source
+		}
+	}
+	sourcePath := func(p string) string {
+		if source, ok := sourcePaths[p]; ok {
+			return source
+		}
+		return p
+	}
+	if len(pkgs) > 0 {
+		// The target package itself was checked by Check
+		pkgs = pkgs[:len(pkgs)-1]
+	}
+	for _, pkg := range pkgs {
+		if pkg.Standard {
+			// The standard library is trusted
+			continue
+		}
+		_, trusted := matchAny(self.trusted, sourcePath(pkg.ImportPath))
+		for _, imported := range pkg.Imports {
+			importPath := sourcePath(imported)
+			allowed, rule := self.explain(importPath)
+			if _, denied := self.deniedBy(importPath); denied {
+				violations = append(violations, Violation{
+					Pos:        token.Position{Filename: sourcePath(pkg.ImportPath)},
+					Kind:       DisallowedDependency,
+					ImportPath: importPath,
+					Message:    fmt.Sprintf("Dependency %q imports denied library %q", sourcePath(pkg.ImportPath), importPath),
+					Rule:       rule,
+				})
+			} else if !trusted && !allowed {
+				violations = append(violations, Violation{
+					Pos:        token.Position{Filename: sourcePath(pkg.ImportPath)},
+					Kind:       DisallowedDependency,
+					ImportPath: importPath,
+					Message:    fmt.Sprintf("Dependency %q imports disallowed library %q", sourcePath(pkg.ImportPath), importPath),
+					Rule:       rule,
+				})
+			}
+		}
+	}
+	return violations, nil
+}
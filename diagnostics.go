@@ -0,0 +1,114 @@
+package gosafe
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var diagnosticPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?: (.*)$`)
+
+// Diagnostic is a single error reported by the go toolchain when building checked code.
+type Diagnostic struct {
+	// File is the name of the file the error is in, as given to the Compiler.
+	File string
+	// Line is the line of the error, starting at 1.
+	Line int
+	// Col is the column of the error, starting at 1, or 0 if the toolchain didn't report one.
+	Col int
+	// Message is the error message, including any following indented lines.
+	Message string
+}
+
+func (self Diagnostic) String() string {
+	if self.Col == 0 {
+		return fmt.Sprintf("%v:%v: %v", self.File, self.Line, self.Message)
+	}
+	return fmt.Sprintf("%v:%v:%v: %v", self.File, self.Line, self.Col, self.Message)
+}
+
+// CompileError is returned by gosafe.Compiler.CompileTo, and everything using it, when the go toolchain fails to build checked code.
+// Use errors.As to get hold of it and inspect the individual diagnostics.
+type CompileError struct {
+	Diagnostics []Diagnostic
+}
+
+func (self *CompileError) Error() string {
+	lines := make([]string, len(self.Diagnostics))
+	for index, diagnostic := range self.Diagnostics {
+		lines[index] = diagnostic.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rename returns a copy of this CompileError with the files of the diagnostics renamed by name.
+func (self *CompileError) rename(name func(string) string) *CompileError {
+	rval := &CompileError{Diagnostics: make([]Diagnostic, len(self.Diagnostics))}
+	for index, diagnostic := range self.Diagnostics {
+		diagnostic.File = name(diagnostic.File)
+		rval.Diagnostics[index] = diagnostic
+	}
+	return rval
+}
+
+// parseDiagnostics returns the diagnostics in output from the go toolchain, with the file names as printed by the toolchain, or nil if there are none.
+// Lines starting with # name the package being built, and indented lines continue the message of the diagnostic before them.
+func parseDiagnostics(output string) (rval []Diagnostic) {
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if strings.HasPrefix(line, "\t") && len(rval) > 0 {
+			rval[len(rval)-1].Message = fmt.Sprint(rval[len(rval)-1].Message, "\n", line)
+			continue
+		}
+		match := diagnosticPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		diagnostic := Diagnostic{File: match[1], Message: match[4]}
+		diagnostic.Line, _ = strconv.Atoi(match[2])
+		if match[3] != "" {
+			diagnostic.Col, _ = strconv.Atoi(match[3])
+		}
+		rval = append(rval, diagnostic)
+	}
+	return rval
+}
+
+// sourceName returns the name of the file printed as printed by the go toolchain in the throwaway module built from files, the way the caller
+// named it: one of files for files in the main package, or a file in the source directory of a replaced package.
+func (self *Compiler) sourceName(files []string, printed string) string {
+	clean := filepath.Clean(printed)
+	// Instrumented files use //line comments with the names of the original files
+	for _, file := range files {
+		if filepath.Clean(file) == clean {
+			return file
+		}
+	}
+	if filepath.Dir(clean) == "." {
+		for _, file := range files {
+			if filepath.Base(file) == clean {
+				return file
+			}
+		}
+		return printed
+	}
+	parts := strings.Split(filepath.ToSlash(clean), "/")
+	if len(parts) < 4 || parts[0] != ".." || parts[1] != "replaced" {
+		return printed
+	}
+	index, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return printed
+	}
+	var paths []string
+	for p, _ := range self.replaced {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if index < 0 || index >= len(paths) {
+		return printed
+	}
+	return filepath.Join(self.replaced[paths[index]], filepath.Join(parts[3:]...))
+}
@@ -0,0 +1,190 @@
+package gosafe
+
+import (
+	"context"
+	"fmt"
+	"go/build"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// buildContext returns the go/build.Context go build uses when this gosafe.Compiler builds code with options: for its GOOS and GOARCH, without
+// cgo, and with the build tags of options.
+func (self *Compiler) buildContext(options BuildOptions) build.Context {
+	rval := build.Default
+	rval.GOOS = self.GOOS
+	rval.GOARCH = self.GOARCH
+	rval.CgoEnabled = false
+	rval.BuildTags = options.Tags
+	rval.ToolTags = nil
+	for _, tag := range build.Default.ToolTags {
+		// The microarchitecture tags depend on the target platform
+		if !strings.HasPrefix(tag, "amd64.") {
+			rval.ToolTags = append(rval.ToolTags, tag)
+		}
+	}
+	if self.GOARCH == "amd64" {
+		level := 1
+		if goamd64Pattern.MatchString(options.GOAMD64) {
+			level = int(options.GOAMD64[1] - '0')
+		}
+		for index := 1; index <= level; index++ {
+			rval.ToolTags = append(rval.ToolTags, fmt.Sprint("amd64.v", index))
+		}
+	}
+	return rval
+}
+
+// dirFiles returns the Go files go build would compile for the package in dir in buildContext, along with violations for all files go build would
+// also use but that the policy can't vet.
+func dirFiles(buildContext build.Context, dir string) (files []string, violations []Violation, err error) {
+	pkg, err := buildContext.ImportDir(dir, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, names := range [][]string{pkg.GoFiles, pkg.CgoFiles} {
+		for _, name := range names {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// Test files are not part of a program to run
+	violations = fileViolations(dir, append(unvettedFiles(pkg), append(pkg.TestGoFiles, pkg.XTestGoFiles...)...))
+	return files, violations, nil
+}
+
+// unvettedFiles returns the names of the files in pkg that go build would use without them being checked, like assembly or C sources.
+func unvettedFiles(pkg *build.Package) (rval []string) {
+	for _, names := range [][]string{
+		pkg.SFiles,
+		pkg.CFiles,
+		pkg.CXXFiles,
+		pkg.HFiles,
+		pkg.MFiles,
+		pkg.FFiles,
+		pkg.SwigFiles,
+		pkg.SwigCXXFiles,
+		pkg.SysoFiles,
+	} {
+		rval = append(rval, names...)
+	}
+	return rval
+}
+
+// fileViolations returns DisallowedFile violations for the files with the given names in dir.
+func fileViolations(dir string, names []string) (violations []Violation) {
+	for _, name := range names {
+		violations = append(violations, Violation{
+			Pos:     token.Position{Filename: filepath.Join(dir, name)},
+			Kind:    DisallowedFile,
+			Message: fmt.Sprint("Disallowed file ", name),
+		})
+	}
+	return violations
+}
+
+// CheckDir will return an error if this gosafe.Compiler doesn't allow the package in the given directory to be compiled.
+// Files are selected, and build constraints evaluated, the way go build would for the GOOS, GOARCH and BuildOptions of this gosafe.Compiler.
+// Packages containing assembly, C, C++, Fortran, Objective-C, SWIG, syso or test files are not allowed, since they can't be checked.
+func (self *Compiler) CheckDir(dir string) error {
+	compiler := self.snapshot()
+	_, err := compiler.checkDir(context.Background(), dir, compiler.BuildOptions)
+	return err
+}
+
+// CheckDirWarnings will return an error like CheckDir does, and otherwise the violations with Warning severity found in the package in the given
+// directory.
+func (self *Compiler) CheckDirWarnings(dir string) ([]Violation, error) {
+	compiler := self.snapshot()
+	return compiler.checkDir(context.Background(), dir, compiler.BuildOptions)
+}
+
+// checkDir checks the package in dir, with the files go build would use when building it with options.
+func (self *Compiler) checkDir(ctx context.Context, dir string, options BuildOptions) ([]Violation, error) {
+	files, violations, err := dirFiles(self.buildContext(options), dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		return nil, &CheckError{Violations: violations}
+	}
+	return self.check(ctx, files, nil)
+}
+
+// compileDir builds the package in dir with options to output if checkDir accepts it. The files are selected once, so that the same files are
+// checked and built.
+func (self *Compiler) compileDir(ctx context.Context, dir, output string, options BuildOptions) (*BuildResult, error) {
+	files, violations, err := dirFiles(self.buildContext(options), dir)
+	if err != nil {
+		return nil, err
+	}
+	return self.compileTo(ctx, files, nil, output, options, func(sources map[string][]byte) ([]Violation, error) {
+		if len(violations) > 0 {
+			return nil, &CheckError{Violations: violations}
+		}
+		return self.check(ctx, files, sources)
+	})
+}
+
+// RunDir will start a gosafe.Cmd encapsulating the package in the given directory and return it.
+func (self *Compiler) RunDir(dir string) (cmd *Cmd, err error) {
+	cmd, err = self.CommandDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Start()
+	return cmd, nil
+}
+
+// CommandDir will return a gosafe.Cmd encapsulating the package in the given directory.
+func (self *Compiler) CommandDir(dir string) (cmd *Cmd, err error) {
+	return self.CommandDirContext(context.Background(), dir)
+}
+
+// CommandDirContext will return a gosafe.Cmd encapsulating the package in the given directory, and stop checking and compiling it when ctx is done.
+func (self *Compiler) CommandDirContext(ctx context.Context, dir string) (cmd *Cmd, err error) {
+	compiled, err := self.CompileDirContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	return newCmd(compiled), nil
+}
+
+// CompileDir will compile the package in the given directory to a temporary file if deemed safe, and return the path to the resulting binary.
+func (self *Compiler) CompileDir(dir string) (output string, err error) {
+	return self.CompileDirContext(context.Background(), dir)
+}
+
+// CompileDirContext will compile the package in the given directory to a temporary file if deemed safe, and return the path to the resulting binary.
+// When ctx is done checking and compiling stops, and all go toolchain processes are killed.
+func (self *Compiler) CompileDirContext(ctx context.Context, dir string) (output string, err error) {
+	compiler := self.snapshot()
+	output = path.Join(os.TempDir(), fmt.Sprintf("%s.gosafe", compiler.shorten(dir)))
+	if _, err = compiler.compileDir(ctx, dir, output, compiler.BuildOptions); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// CompileDirTo will compile the package in the given directory to a given path file if deemed safe.
+func (self *Compiler) CompileDirTo(dir, output string) error {
+	compiler := self.snapshot()
+	_, err := compiler.compileDir(context.Background(), dir, output, compiler.BuildOptions)
+	return err
+}
+
+// CompileDirToWith will compile the package in the given directory to a given path file if deemed safe, using options instead of the BuildOptions
+// of this gosafe.Compiler, and describe the result.
+func (self *Compiler) CompileDirToWith(dir, output string, options BuildOptions) (*BuildResult, error) {
+	return self.CompileDirToContext(context.Background(), dir, output, options)
+}
+
+// CompileDirToContext will compile the package in the given directory to a given path file if deemed safe, using options instead of the
+// BuildOptions of this gosafe.Compiler, and describe the result. When ctx is done checking and compiling stops, and all go toolchain processes
+// are killed.
+func (self *Compiler) CompileDirToContext(ctx context.Context, dir, output string, options BuildOptions) (*BuildResult, error) {
+	compiler := self.snapshot()
+	return compiler.compileDir(ctx, dir, output, options)
+}
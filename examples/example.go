@@ -2,7 +2,7 @@
 package main
 
 import (
-	gosafe "../"
+	gosafe "github.com/zond/gosafe"
 	"fmt"
 	"io/ioutil"
 )
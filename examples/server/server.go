@@ -1,7 +1,7 @@
 package main
 
 import (
-	gosafe "../../"
+	gosafe "github.com/zond/gosafe"
 	"fmt"
 )
 
@@ -20,8 +20,8 @@ func set(args... interface{}) interface{} {
 func main() {
 	db = make(map[string]interface{})
 	c := gosafe.NewCompiler()
-	c.Allow("../../child")
-	cmd, err := c.CommandFile("child.go")
+	c.Allow(gosafe.ChildPackage)
+	cmd, err := c.CommandFile("program/child.go")
 	if err != nil {
 		panic(err.Error())
 	}
@@ -2,7 +2,7 @@
 package main
 
 import (
-	"../../child"
+	"github.com/zond/gosafe/child"
 	"fmt"
 	"time"
 )
@@ -1,7 +1,7 @@
 package main
 
 import (
-	gosafe "../../"
+	gosafe "github.com/zond/gosafe"
 	"fmt"
 	"time"
 )
@@ -18,10 +18,10 @@ func fetch(cmd *gosafe.Cmd) {
 
 func main() {
 	c := gosafe.NewCompiler()
-	c.Allow("../../child")
+	c.Allow(gosafe.ChildPackage)
 	c.Allow("fmt")
 	c.Allow("time")
-	if cmd, err := c.CommandFile("child.go"); err == nil {
+	if cmd, err := c.CommandFile("program/child.go"); err == nil {
 		cmd.Timeout = time.Second / 2
 		fetch(cmd)
 		fetch(cmd)
@@ -0,0 +1,138 @@
+package gosafe
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// gasName is the name ChildPackage is imported as in instrumented code.
+const gasName = "gosafe_gas"
+
+// gasFile is the name of the file setting the gas of instrumented programs, in their copy of ChildPackage.
+const gasFile = "gosafe_gas.go"
+
+// instrumentedPrinter prints instrumented files with //line comments mapping them back to the original files, so that the toolchain reports
+// errors at their original lines.
+var instrumentedPrinter = &printer.Config{Mode: printer.SourcePos | printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+
+func stepStmt() ast.Stmt {
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{X: ast.NewIdent(gasName), Sel: ast.NewIdent("Step")},
+		},
+	}
+}
+
+// meterGotos wraps all goto statements in stmts in blocks calling child.Step first, since they can be used to build loops.
+func meterGotos(stmts []ast.Stmt) {
+	for index, stmt := range stmts {
+		if branch, ok := stmt.(*ast.BranchStmt); ok && branch.Tok == token.GOTO {
+			stmts[index] = &ast.BlockStmt{List: []ast.Stmt{stepStmt(), branch}}
+		}
+	}
+}
+
+// instrument rewrites tree to call child.Step at the start of every function and loop iteration, and before every goto statement,
+// so that no code can run for long without spending gas.
+func instrument(tree *ast.File) {
+	// Collected before rewriting, so that the inserted statements aren't instrumented themselves
+	var bodies []*ast.BlockStmt
+	var lists [][]ast.Stmt
+	var labeled []*ast.LabeledStmt
+	ast.Inspect(tree, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncDecl:
+			if node.Body != nil {
+				bodies = append(bodies, node.Body)
+			}
+		case *ast.FuncLit:
+			bodies = append(bodies, node.Body)
+		case *ast.ForStmt:
+			bodies = append(bodies, node.Body)
+		case *ast.RangeStmt:
+			bodies = append(bodies, node.Body)
+		case *ast.BlockStmt:
+			lists = append(lists, node.List)
+		case *ast.CaseClause:
+			lists = append(lists, node.Body)
+		case *ast.CommClause:
+			lists = append(lists, node.Body)
+		case *ast.LabeledStmt:
+			labeled = append(labeled, node)
+		}
+		return true
+	})
+	for _, stmts := range lists {
+		meterGotos(stmts)
+	}
+	for _, stmt := range labeled {
+		stmts := []ast.Stmt{stmt.Stmt}
+		meterGotos(stmts)
+		stmt.Stmt = stmts[0]
+	}
+	for _, body := range bodies {
+		body.List = append([]ast.Stmt{stepStmt()}, body.List...)
+	}
+	importDecl := &ast.GenDecl{
+		Tok: token.IMPORT,
+		Specs: []ast.Spec{
+			&ast.ImportSpec{Name: ast.NewIdent(gasName), Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(ChildPackage)}},
+		},
+	}
+	// Files without functions would otherwise not use the import
+	useDecl := &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{
+			&ast.ValueSpec{Names: []*ast.Ident{ast.NewIdent("_")}, Values: []ast.Expr{&ast.SelectorExpr{X: ast.NewIdent(gasName), Sel: ast.NewIdent("Step")}}},
+		},
+	}
+	imports := 0
+	for imports < len(tree.Decls) {
+		if genDecl, ok := tree.Decls[imports].(*ast.GenDecl); !ok || genDecl.Tok != token.IMPORT {
+			break
+		}
+		imports++
+	}
+	decls := append([]ast.Decl{importDecl}, tree.Decls[:imports]...)
+	decls = append(decls, useDecl)
+	tree.Decls = append(decls, tree.Decls[imports:]...)
+}
+
+// writeInstrumented writes instrumented copies of files, with the contents in sources, to dir.
+func (self *Compiler) writeInstrumented(files []string, sources map[string][]byte, dir string) error {
+	if _, ok := self.replaced[ChildPackage]; !ok {
+		return Error(fmt.Sprintf("Gas requires the source of %v, use Replace to provide it", ChildPackage))
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		tree, err := parser.ParseFile(fset, file, sources[file], parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		instrument(tree)
+		out, err := os.OpenFile(filepath.Join(dir, filepath.Base(file)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		err = instrumentedPrinter.Fprint(out, fset, tree)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeGas writes a file setting the Gas of this gosafe.Compiler to dir, the copy of ChildPackage in the throwaway module.
+// The gas is set from inside the package, so that checked code has no way to change it.
+func (self *Compiler) writeGas(dir string) error {
+	source := fmt.Sprintf("package child\n\nfunc init() {\n\tsetGas(%v)\n}\n", self.Gas)
+	return ioutil.WriteFile(filepath.Join(dir, gasFile), []byte(source), 0600)
+}
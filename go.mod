@@ -0,0 +1,5 @@
+module github.com/zond/gosafe
+
+go 1.22.0
+
+require golang.org/x/tools v0.30.0
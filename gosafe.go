@@ -12,32 +12,37 @@
 package gosafe
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/zond/gosafe/child"
-	"github.com/zond/tools"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
-	"hash"
+	"golang.org/x/tools/go/analysis"
 	"io"
+	"io/ioutil"
+	"maps"
+	"math/big"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const HANDLER_TIMEOUT = time.Second * 10
 
-var hasher hash.Hash
-
-func init() {
-	hasher = sha1.New()
-}
-
 type visitor func(ast.Node)
 
 func (self visitor) Visit(node ast.Node) ast.Visitor {
@@ -51,6 +56,111 @@ func (self Error) Error() string {
 	return string(self)
 }
 
+// ViolationKind describes what part of the Compiler policy a Violation broke.
+type ViolationKind string
+
+const (
+	// DisallowedImport is the kind of Violation caused by importing a package the Compiler doesn't allow.
+	DisallowedImport ViolationKind = "disallowed import"
+	// DisallowedDirective is the kind of Violation caused by a //go: compiler directive the Compiler doesn't allow.
+	DisallowedDirective ViolationKind = "disallowed directive"
+	// DisallowedSymbol is the kind of Violation caused by using a symbol the Compiler doesn't allow.
+	DisallowedSymbol ViolationKind = "disallowed symbol"
+	// TypeError is the kind of Violation caused by code that doesn't type check.
+	TypeError ViolationKind = "type error"
+	// DisallowedDependency is the kind of Violation caused by a dependency of the checked code importing a package the Compiler doesn't allow.
+	DisallowedDependency ViolationKind = "disallowed dependency"
+	// DisallowedFile is the kind of Violation caused by a file in a checked directory, or in an imported replaced package that is not trusted,
+	// that can't be checked, like assembly or C sources.
+	DisallowedFile ViolationKind = "disallowed file"
+	// SyntaxError is the kind of Violation caused by code that doesn't parse.
+	SyntaxError ViolationKind = "syntax error"
+	// RuleViolation is the kind of Violation found by a Rule that didn't set a Kind of its own.
+	RuleViolation ViolationKind = "rule violation"
+	// LimitExceeded is the kind of Violation caused by code exceeding the Limits of the Compiler.
+	LimitExceeded ViolationKind = "limit exceeded"
+	// DisallowedLinkage is the kind of Violation caused by a binary, verified because of Compiler.VerifyBinary, containing code from a package
+	// the Compiler doesn't allow, cgo or dynamic linking.
+	DisallowedLinkage ViolationKind = "disallowed linkage"
+	// AnalyzerFinding is the kind of Violation reported by an analyzer enabled with Compiler.EnableAnalyzer.
+	AnalyzerFinding ViolationKind = "analyzer finding"
+)
+
+// Severity describes whether a Violation stops the checked code from being built.
+type Severity int
+
+const (
+	// Blocking violations stop the checked code from being built. All violations except analyzer findings are blocking.
+	Blocking Severity = iota
+	// Warning violations are reported, but don't stop the checked code from being built.
+	Warning
+)
+
+func (self Severity) String() string {
+	if self == Warning {
+		return "warning"
+	}
+	return "blocking"
+}
+
+// Violation describes a single breach of the Compiler policy found by Compiler.Check.
+type Violation struct {
+	// Pos is the position in the checked source where the violation was found.
+	Pos token.Position
+	// Kind is the kind of policy that was violated.
+	Kind ViolationKind
+	// ImportPath is the (unquoted) import path involved in the violation, if any.
+	ImportPath string
+	// Message is a human readable description of the violation.
+	Message string
+	// Rule describes the rule of the policy that caused the violation, if any, like `deny "encoding/gob"` or "no allow rule".
+	Rule string
+	// Severity is whether the violation stops the checked code from being built.
+	Severity Severity
+}
+
+func (self Violation) String() string {
+	if self.Severity == Warning {
+		return fmt.Sprintf("%v: warning: %v", self.Pos, self.Message)
+	}
+	return fmt.Sprintf("%v: %v", self.Pos, self.Message)
+}
+
+/*
+ CheckError is returned by gosafe.Compiler.Check, and everything using it (Compile, CompileTo, Command, Run...), when the checked code violates the policy of the Compiler.
+
+ Use errors.As to get hold of it and inspect the individual violations.
+*/
+type CheckError struct {
+	Violations []Violation
+}
+
+func (self *CheckError) Error() string {
+	lines := make([]string, len(self.Violations))
+	for index, violation := range self.Violations {
+		lines[index] = violation.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortViolations(violations []Violation) {
+	sort.SliceStable(violations, func(i, j int) bool {
+		if violations[i].Pos.Filename != violations[j].Pos.Filename {
+			return violations[i].Pos.Filename < violations[j].Pos.Filename
+		}
+		return violations[i].Pos.Offset < violations[j].Pos.Offset
+	})
+}
+
+// ByKind returns the violations of this CheckError grouped by their Kind.
+func (self *CheckError) ByKind() map[ViolationKind][]Violation {
+	rval := make(map[ViolationKind][]Violation)
+	for _, violation := range self.Violations {
+		rval[violation.Kind] = append(rval[violation.Kind], violation)
+	}
+	return rval
+}
+
 /*
  A wrapper around os/exec.Cmd that provides ready io.Readers and io.Writers for communicating with the contained process.
 
@@ -170,7 +280,7 @@ func createRequest(response child.Response) (rval child.Request, err error) {
 // Call will call one function registered via child.Server#Register and return its return value.
 func (self *Cmd) Call(name string, args ...interface{}) (rval interface{}, err error) {
 	response := child.Response{}
-	self.Handle(child.Request{name, args}, &response)
+	self.Handle(child.Request{Name: name, Args: args}, &response)
 	for {
 		if response.Type == child.Return {
 			break
@@ -181,7 +291,7 @@ func (self *Cmd) Call(name string, args ...interface{}) (rval interface{}, err e
 				response = child.Response{}
 				self.Handle(self.server.Handle(request), &response)
 			} else {
-				self.Encode(child.Response{child.Error, err})
+				self.Encode(child.Response{Type: child.Error, Payload: err})
 				return nil, err
 			}
 		} else {
@@ -200,7 +310,7 @@ func (self *Cmd) Handle(i, o interface{}) error {
 	self.lastEvent = time.Now()
 	err := self.Encode(i)
 	if err != nil {
-		if err.Error() == "write |1: bad file descriptor" {
+		if err.Error() == "write |1: bad file descriptor" || errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
 			return self.reHandle(i, o)
 		}
 		return err
@@ -230,23 +340,42 @@ func (self *Cmd) Start() error {
 	self.encoder = nil
 	self.decoder = nil
 	self.lastEvent = time.Now()
-	var err error
-	if self.Stdin, err = self.Cmd.StdinPipe(); err != nil {
+	if self.Stdin != nil {
+		self.Stdin.Close()
+	}
+	if closer, ok := self.Stdout.(io.Closer); ok {
+		closer.Close()
+	}
+	// Plain pipes, since the ones from StdinPipe and StdoutPipe are closed by Wait, even if there is unread output left
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
 		return err
 	}
-	if self.Stdout, err = self.Cmd.StdoutPipe(); err != nil {
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
 		return err
 	}
+	self.Cmd.Stdin = stdinReader
+	self.Cmd.Stdout = stdoutWriter
+	self.Stdin = stdinWriter
+	self.Stdout = stdoutReader
 	if self.Stderr == nil {
 		self.Cmd.Stderr = os.Stderr
 	} else {
 		self.Cmd.Stderr = self.Stderr
 	}
-	if err := self.Cmd.Start(); err != nil {
+	err = self.Cmd.Start()
+	// The child process has its own copies of these now
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
 		return err
 	}
+	cmd := self.Cmd
 	go func() {
-		if err = self.Cmd.Wait(); err != nil {
+		if err := cmd.Wait(); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 	}()
@@ -254,77 +383,507 @@ func (self *Cmd) Start() error {
 }
 
 // A compiler of potentially unsafe code.
+// Its methods are safe for concurrent use, but its exported fields should be set before it is used concurrently.
 type Compiler struct {
-	allowed    map[string]bool
-	okChecked  map[string]time.Time
-	okCompiled map[string]time.Time
+	*compilerState
+	allowed        map[string]bool
+	denied         map[string]bool
+	trusted        map[string]bool
+	allowedSymbols map[string]map[string]bool
+	deniedSymbols  map[string]map[string]bool
+	directives     map[string]bool
+	rules          []Rule
+	replaced       map[string]string
+	analyzers      map[*analysis.Analyzer]Severity
+	// VerifyDependencies makes Check compute the transitive import closure of the checked code using `go list -deps`,
+	// and fail if any non standard library package in it imports a denied package, or a package that is not allowed
+	// unless the importing package is trusted.
+	VerifyDependencies bool
+	// VerifyBinary makes CompileTo read the build info and symbols of every built binary, and fail if it contains code from packages that are
+	// neither allowed, trusted nor in the transitive import closure of those, if it uses cgo, or if it is dynamically linked.
+	// Only ELF binaries can be verified.
+	VerifyBinary bool
+	// TypeCheck makes Check type check the checked code using go/types, only importing allowed packages, and return type errors as violations.
+	// The checked code isn't built, but the export data of the imported packages is built by the Toolchain for GOOS, GOARCH and BuildOptions
+	// using go list, and cached until the toolchain version, platform, BuildOptions or replaced packages change.
+	TypeCheck bool
+	// PartialCheck makes Check check the import and directive policy of code that doesn't parse as well, so that both syntax errors and
+	// violations of the policy are returned at once. Code that doesn't parse is never built.
+	PartialCheck bool
+	// Limits are the size and complexity limits of the checked code, to stop it from making go build use excessive resources.
+	Limits Limits
+	// Gas makes built code spend one step of gas at the start of every function and loop iteration, and makes every Request handled by a
+	// child.Server fail with a child.Error response when more than Gas steps are taken while handling it. Zero means no gas is spent.
+	// Goroutines started by a Request spend its gas. When they run out of it the child process exits after responding, and so does a child process
+	// whose Request left goroutines running, so that they can't spend the gas of the next Request. Checked code may not use child.Step or
+	// child.Server.Handle. Requires the source of ChildPackage, which new Compilers replace automatically when available.
+	Gas int64
+	// BuildTimeout is the longest time the go toolchain may run when checking or building code. Zero means no limit.
+	// Defaults to DefaultBuildTimeout.
+	BuildTimeout time.Duration
+	// BuildMemory is the largest address space, in bytes, of each process of the go toolchain when checking or building code. Zero means no limit.
+	BuildMemory int64
+	// BuildCPU is the most CPU time each process of the go toolchain may use when checking or building code. Zero means no limit.
+	BuildCPU time.Duration
+	// BuildNamespaces makes the go toolchain run in new user and network namespaces when checking or building code. Only supported on Linux.
+	BuildNamespaces bool
+	// BuildCache is the go build cache directory used when building code, kept apart from the cache of the user to make sure checked code
+	// can't poison it. Defaults to a gosafe directory in the user cache directory.
+	BuildCache string
+	// ModCache is the go module cache directory used when building code, kept apart from the cache of the user like BuildCache.
+	// Defaults to a gosafe directory in the user cache directory.
+	ModCache string
+	// GOOS and GOARCH are the operating system and architecture to build code for. Binaries built for another platform than the current one
+	// can't be run as child processes. Default to the current platform.
+	GOOS   string
+	GOARCH string
+	// CacheDir is the directory where built binaries are cached, keyed by a digest of their source, the policy and the toolchain version,
+	// so that they survive restarts and can be shared between processes. Empty means no binaries are cached.
+	// Defaults to a gosafe directory in the user cache directory.
+	CacheDir string
+	// CacheSize is the largest total size, in bytes, of the binaries in CacheDir before the least recently used ones are evicted.
+	// Zero means no limit. Defaults to DefaultCacheSize.
+	CacheSize int64
+	// MaxBuilds is the largest number of go toolchain processes run at once when checking or building code. Zero means no limit.
+	// Defaults to the number of CPUs.
+	MaxBuilds int
+	// BuildOptions are the options of go build when building code, unless other options are given to CompileToWith or CompileDirToWith.
+	BuildOptions BuildOptions
+	// Toolchain is the go toolchain used to check and build code: the path of a go binary, or of a GOROOT directory.
+	// Empty means the go binary in PATH. Toolchains older than MinToolchainVersion are refused.
+	Toolchain string
+	// GoVersion is the go version used in the go.mod files of the throwaway modules the checked code is built in.
+	// Defaults to the language version of the go toolchain.
+	GoVersion string
 }
 
+// compilerState is the state of a gosafe.Compiler shared with the snapshots of it that check and build code.
+type compilerState struct {
+	// lock guards the policy, and is held for reading while taking snapshots
+	lock sync.RWMutex
+	// cacheLock guards the caches, the work directory and the running builds
+	cacheLock sync.Mutex
+	// buildDone is signaled when a go toolchain process finishes
+	buildDone *sync.Cond
+	running   int
+	flights   map[string]*flight
+	workDir   string
+	// the export data of the packages imported by checked code, and the importKey it is for
+	imports    *exportImporter
+	importsKey string
+	// the version of the toolchain, and the Toolchain it was read from
+	version          string
+	versionToolchain string
+	// the warnings of checks without blocking violations, by check key
+	okChecked map[string][]Violation
+	// the compile keys of the binaries built, by output path
+	okCompiled map[string]string
+}
+
+// snapshot returns a copy of this gosafe.Compiler with its own copy of the policy, sharing the caches and running builds with it.
+// Code is checked and built by snapshots, so that the policy can change while the toolchain runs without affecting running checks and builds.
+func (self *Compiler) snapshot() *Compiler {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	rval := *self
+	rval.allowed = maps.Clone(self.allowed)
+	rval.denied = maps.Clone(self.denied)
+	rval.trusted = maps.Clone(self.trusted)
+	rval.allowedSymbols = cloneSymbols(self.allowedSymbols)
+	rval.deniedSymbols = cloneSymbols(self.deniedSymbols)
+	rval.directives = maps.Clone(self.directives)
+	rval.rules = slices.Clone(self.rules)
+	rval.replaced = maps.Clone(self.replaced)
+	rval.analyzers = maps.Clone(self.analyzers)
+	return &rval
+}
+
+func cloneSymbols(symbols map[string]map[string]bool) map[string]map[string]bool {
+	rval := make(map[string]map[string]bool, len(symbols))
+	for p, names := range symbols {
+		rval[p] = maps.Clone(names)
+	}
+	return rval
+}
+
+// DefaultDirectives are the //go: compiler directives allowed by new Compilers, since they can't be used to escape the allowed packages.
+var DefaultDirectives = []string{"build", "generate"}
+
 func NewCompiler() *Compiler {
-	return &Compiler{make(map[string]bool), make(map[string]time.Time), make(map[string]time.Time)}
+	rval := &Compiler{
+		compilerState: &compilerState{
+			okChecked:  make(map[string][]Violation),
+			okCompiled: make(map[string]string),
+			flights:    make(map[string]*flight),
+		},
+		allowed:        make(map[string]bool),
+		denied:         make(map[string]bool),
+		trusted:        make(map[string]bool),
+		allowedSymbols: make(map[string]map[string]bool),
+		deniedSymbols:  make(map[string]map[string]bool),
+		directives:     make(map[string]bool),
+		replaced:       make(map[string]string),
+		analyzers:      make(map[*analysis.Analyzer]Severity),
+		MaxBuilds:      runtime.NumCPU(),
+		BuildTimeout:   DefaultBuildTimeout,
+		BuildCache:     defaultBuildCache(),
+		ModCache:       defaultModCache(),
+		GOOS:           runtime.GOOS,
+		GOARCH:         runtime.GOARCH,
+		CacheDir:       defaultCacheDir(),
+		CacheSize:      DefaultCacheSize,
+	}
+	rval.buildDone = sync.NewCond(&rval.cacheLock)
+	for _, directive := range DefaultDirectives {
+		rval.AllowDirective(directive)
+	}
+	if dir, ok := childDir(); ok {
+		rval.Replace(ChildPackage, dir)
+	}
+	return rval
 }
 
 // AllowRuntime will allow the runtime package for this gosafe.Compiler.
 // See https://github.com/zond/gosafe/issues/1 as to why this is necessary.
 func (self *Compiler) AllowRuntime() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allowRuntime()
+}
+
+func (self *Compiler) allowRuntime() {
 	self.allowed[fmt.Sprint("\"runtime\"")] = true
 }
 
 // Allow will add p to the allowed list of golang packages for this gosafe.Compiler.
-// It will NOT allow the runtime package - including that one requires a more conscious effort.
+// p can be a pattern like "encoding/..." that matches encoding and all packages below it, or contain "..." anywhere else to match any string.
+// It will NOT allow the runtime package, not even using patterns - including that one requires a more conscious effort.
 // See https://github.com/zond/gosafe/issues/1 as to why this is necessary.
 func (self *Compiler) Allow(p string) {
 	if p == "runtime" {
 		panic(fmt.Errorf("Allowing \"runtime\" requires you to use Compiler#AllowRuntime. See https://github.com/zond/gosafe/issues/1"))
 	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allow(p)
+}
+
+func (self *Compiler) allow(p string) {
 	self.allowed[fmt.Sprint("\"", p, "\"")] = true
 }
+
+// Deny will add p, that can be a pattern like for Allow, to the denied list of golang packages for this gosafe.Compiler.
+// Denied packages can't be imported even if they are allowed, and with VerifyDependencies they can't be imported by any non standard library
+// dependency either.
+func (self *Compiler) Deny(p string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.deny(p)
+}
+
+func (self *Compiler) deny(p string) {
+	self.denied[strconv.Quote(p)] = true
+}
+
+// Trust will allow importing the vetted package p, that can be a pattern like for Allow, for this gosafe.Compiler.
+// With VerifyDependencies, trusted packages may import any package not denied, while other non standard library packages may only import
+// allowed packages.
+func (self *Compiler) Trust(p string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.trust(p)
+}
+
+func (self *Compiler) trust(p string) {
+	self.trusted[strconv.Quote(p)] = true
+}
+
+// AllowDirective will allow the //go: compiler directive d (like "noinline" for //go:noinline) for this gosafe.Compiler.
+// All directives except the DefaultDirectives are disallowed by default, since some of them (like //go:linkname) can reach
+// into packages without importing them.
+func (self *Compiler) AllowDirective(d string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allowDirective(d)
+}
+
+func (self *Compiler) allowDirective(d string) {
+	self.directives[d] = true
+}
+
+// AllowSymbol will allow importing p, but only using its package level identifier name (like "Getenv" for os.Getenv) for this gosafe.Compiler.
+// Methods are named like "Type.Method", allowing a type allows its methods, and name can be a path.Match pattern.
+// Symbols are resolved using go/types, so aliased and dot imports are restricted as well, and files using symbol restrictions must type check.
+// Allowing the whole package using Allow overrides AllowSymbol.
+func (self *Compiler) AllowSymbol(p, name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allowSymbol(p, name)
+}
+
+func (self *Compiler) allowSymbol(p, name string) {
+	if self.allowedSymbols[p] == nil {
+		self.allowedSymbols[p] = make(map[string]bool)
+	}
+	self.allowedSymbols[p][name] = true
+}
+
+// DenySymbol will deny using the package level identifier name (with the same format as for AllowSymbol) of package p for this gosafe.Compiler,
+// even if the package is allowed.
+func (self *Compiler) DenySymbol(p, name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.denySymbol(p, name)
+}
+
+func (self *Compiler) denySymbol(p, name string) {
+	if self.deniedSymbols[p] == nil {
+		self.deniedSymbols[p] = make(map[string]bool)
+	}
+	self.deniedSymbols[p][name] = true
+}
+
 func (self *Compiler) shorten(s string) string {
-	hasher.Reset()
-	for allowed, _ := range self.allowed {
-		hasher.Write([]byte(allowed))
+	hasher := sha1.New()
+	// Sorted, to get the same hash for the same allowed packages every time
+	allowed := make([]string, 0, len(self.allowed))
+	for p, _ := range self.allowed {
+		allowed = append(allowed, p)
+	}
+	sort.Strings(allowed)
+	for _, p := range allowed {
+		hasher.Write([]byte(p))
 	}
 	hasher.Write([]byte(s))
-	return tools.NewBigIntBytes(hasher.Sum(nil)).BaseString(tools.MAX_BASE)
+	return new(big.Int).SetBytes(hasher.Sum(nil)).Text(big.MaxBase)
 }
 
 // Check will return an error if this gosafe.Compiler doesn't allow  the given file to be compiled.
+// Policy violations are returned as a *gosafe.CheckError.
 func (self *Compiler) Check(file string) error {
-	fstat, err := os.Stat(file)
+	compiler := self.snapshot()
+	_, err := compiler.check(context.Background(), []string{file}, nil)
+	return err
+}
+
+// CheckWarnings will return an error like Check does, and otherwise the violations with Warning severity found in the given file.
+func (self *Compiler) CheckWarnings(file string) ([]Violation, error) {
+	compiler := self.snapshot()
+	return compiler.check(context.Background(), []string{file}, nil)
+}
+
+// checked returns a CheckError if any of violations is blocking, and otherwise the warnings among them.
+func checked(violations []Violation) ([]Violation, error) {
+	var warnings []Violation
+	for _, violation := range violations {
+		if violation.Severity == Warning {
+			warnings = append(warnings, violation)
+		}
+	}
+	if len(warnings) < len(violations) {
+		return nil, &CheckError{Violations: violations}
+	}
+	return warnings, nil
+}
+
+// check checks files as one program, and returns its warnings.
+func (self *Compiler) check(ctx context.Context, files []string, sources map[string][]byte) ([]Violation, error) {
+	sources, err := readSources(files, sources)
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := self.checkCached(ctx, files, sources)
+	if err != nil {
+		return nil, err
+	}
+	if self.VerifyDependencies {
+		// The dependencies may have changed even if the files didn't, so they are always verified
+		if err = self.verifyDeps(ctx, files, sources); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// readSources returns the contents of files, taken from sources if present there and otherwise read from disk.
+// Files are read once, so that they are keyed, checked and built with the same contents even if they change on disk meanwhile.
+func readSources(files []string, sources map[string][]byte) (map[string][]byte, error) {
+	rval := make(map[string][]byte, len(files))
+	for _, file := range files {
+		src, ok := sources[file]
+		if !ok {
+			var err error
+			if src, err = ioutil.ReadFile(file); err != nil {
+				return nil, err
+			}
+		}
+		rval[file] = src
+	}
+	return rval, nil
+}
+
+// checkCached checks files, with the contents in sources, unless they were already checked without blocking violations with the same policy,
+// and returns their warnings.
+func (self *Compiler) checkCached(ctx context.Context, files []string, sources map[string][]byte) ([]Violation, error) {
+	progress(ctx, Checking)
+	key, err := self.checkKey(ctx, files, sources)
+	if err != nil {
+		return nil, err
+	}
+	self.cacheLock.Lock()
+	warnings, ok := self.okChecked[key]
+	self.cacheLock.Unlock()
+	if ok {
+		return warnings, nil
+	}
+	violations, err := self.checkFiles(ctx, files, sources)
+	if err != nil {
+		return nil, err
+	}
+	if warnings, err = checked(violations); err != nil {
+		return nil, err
+	}
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	makeRoom(self.okChecked)
+	self.okChecked[key] = warnings
+	return warnings, nil
+}
+
+// verifyDeps returns a CheckError if the dependencies of the program in files, with the contents in sources, break the policy of this gosafe.Compiler.
+func (self *Compiler) verifyDeps(ctx context.Context, files []string, sources map[string][]byte) error {
+	violations, err := self.checkDeps(ctx, files, sources)
 	if err != nil {
-		// Problem stating file
 		return err
 	}
-	if checkTime, ok := self.okChecked[file]; ok && checkTime.After(fstat.ModTime()) {
-		// Was checked before, and after the file was last changed
-		return nil
+	if len(violations) > 0 {
+		sortViolations(violations)
+		return &CheckError{Violations: violations}
+	}
+	return nil
+}
+
+// checkFiles returns all violations of the policy of this gosafe.Compiler in the given files of one package, with the contents in sources.
+func (self *Compiler) checkFiles(ctx context.Context, files []string, sources map[string][]byte) (violations []Violation, err error) {
+	if violations = self.checkSourceSize(files, sources); len(violations) > 0 {
+		// Too big to even parse
+		return violations, nil
 	}
-	var disallowed []string
-	tree, _ := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	fset := token.NewFileSet()
+	var trees []*ast.File
+	var syntaxViolations []Violation
+	for _, file := range files {
+		tree, err := parser.ParseFile(fset, file, sources[file], parser.ParseComments|parser.AllErrors)
+		if err != nil {
+			syntaxViolations = append(syntaxViolations, parseViolations(file, err)...)
+		}
+		if tree != nil {
+			trees = append(trees, tree)
+		}
+	}
+	if len(syntaxViolations) > 0 {
+		// Code that doesn't parse will never be built, but the policy of partial trees can still be checked to give all problems at once
+		if self.PartialCheck {
+			for _, tree := range trees {
+				syntaxViolations = append(syntaxViolations, self.checkTree(fset, tree)...)
+			}
+		}
+		sortViolations(syntaxViolations)
+		return syntaxViolations, nil
+	}
+	if violations = self.checkLimits(fset, trees); len(violations) > 0 {
+		// Too complex to type check or build
+		sortViolations(violations)
+		return violations, nil
+	}
+	for _, tree := range trees {
+		violations = append(violations, self.checkTree(fset, tree)...)
+	}
+	violations = append(violations, self.checkReplaced(trees)...)
+	if self.TypeCheck || self.hasSymbolRules(trees) || len(self.rules) > 0 || len(self.analyzers) > 0 {
+		// Symbol rules, Rules and analyzers need type information, and unresolved symbols could hide violations, so type errors are violations as well
+		pkg, info, typeViolations, typeErrors, err := self.typeCheck(ctx, fset, trees)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, typeViolations...)
+		violations = append(violations, self.checkSymbols(fset, trees, pkg, info)...)
+		violations = append(violations, self.checkRules(fset, trees, info)...)
+		violations = append(violations, self.checkAnalyzers(fset, trees, pkg, info, typeErrors, sources)...)
+	}
+	sortViolations(violations)
+	return violations, nil
+}
+
+// importAllowed returns whether the checked code may import p.
+func (self *Compiler) importAllowed(p string) bool {
+	allowed, _ := self.explain(p)
+	return allowed
+}
+
+// parseViolations returns the errors from parsing file as violations.
+func parseViolations(file string, err error) (violations []Violation) {
+	if errorList, ok := err.(scanner.ErrorList); ok {
+		for _, syntaxErr := range errorList {
+			violations = append(violations, Violation{
+				Pos:     syntaxErr.Pos,
+				Kind:    SyntaxError,
+				Message: syntaxErr.Msg,
+			})
+		}
+		return violations
+	}
+	return []Violation{
+		Violation{
+			Pos:     token.Position{Filename: file},
+			Kind:    SyntaxError,
+			Message: err.Error(),
+		},
+	}
+}
+
+// checkTree returns the violations of the import and directive policy of this gosafe.Compiler in the given parsed file.
+func (self *Compiler) checkTree(fset *token.FileSet, tree *ast.File) (violations []Violation) {
 	ast.Walk(visitor(func(node ast.Node) {
 		if importNode, isImport := node.(*ast.ImportSpec); isImport {
 			if importNode.Path != nil {
-				if _, ok := self.allowed[importNode.Path.Value]; !ok {
-					// This import declaration imports a package that is not allowed
-					disallowed = append(disallowed, importNode.Path.Value)
+				importPath, _ := strconv.Unquote(importNode.Path.Value)
+				if allowed, rule := self.explain(importPath); !allowed {
+					// This import declaration imports a package that is denied or not allowed
+					message := fmt.Sprint("Import of disallowed library ", importNode.Path.Value)
+					if _, denied := self.deniedBy(importPath); denied {
+						message = fmt.Sprint("Import of denied library ", importNode.Path.Value)
+					}
+					violations = append(violations, Violation{
+						Pos:        fset.Position(importNode.Path.Pos()),
+						Kind:       DisallowedImport,
+						ImportPath: importPath,
+						Message:    message,
+						Rule:       rule,
+					})
 				}
 			}
 		}
 	}), tree)
-	if len(disallowed) > 0 {
-		var buffer bytes.Buffer
-		for index, pkg := range disallowed {
-			fmt.Fprint(&buffer, pkg)
-			if index < len(disallowed)-1 {
-				fmt.Fprint(&buffer, ", ")
+	for _, group := range tree.Comments {
+		for _, comment := range group.List {
+			if strings.HasPrefix(comment.Text, "//go:") {
+				directive := strings.TrimPrefix(comment.Text, "//go:")
+				if index := strings.IndexAny(directive, " \t"); index != -1 {
+					directive = directive[:index]
+				}
+				if _, ok := self.directives[directive]; !ok {
+					// This comment is a compiler directive that is not allowed
+					violations = append(violations, Violation{
+						Pos:     fset.Position(comment.Pos()),
+						Kind:    DisallowedDirective,
+						Message: fmt.Sprint("Disallowed compiler directive //go:", directive),
+					})
+				}
 			}
 		}
-		// We tried to import non-allowed packages
-		return Error(fmt.Sprint("Imports of disallowed libraries: ", string((&buffer).Bytes())))
 	}
-	// We checked this file as OK now
-	self.okChecked[file] = time.Now()
-	return nil
+	return violations
 }
 
 // RunFile will start a gosafe.Cmd encapsulating the given file and return it.
@@ -349,37 +908,45 @@ func (self *Compiler) Run(s string) (cmd *Cmd, err error) {
 
 // CommandFile will return a gosafe.Cmd encapsulating the given file.
 func (self *Compiler) CommandFile(file string) (cmd *Cmd, err error) {
-	compiled, err := self.Compile(file)
+	return self.CommandFileContext(context.Background(), file)
+}
+
+// CommandFileContext will return a gosafe.Cmd encapsulating the given file, and stop checking and compiling it when ctx is done.
+func (self *Compiler) CommandFileContext(ctx context.Context, file string) (cmd *Cmd, err error) {
+	compiled, err := self.CompileContext(ctx, file)
 	if err != nil {
 		return nil, err
 	}
-	cmd = &Cmd{Binary: compiled, server: make(child.Server)}
-	return cmd, nil
+	return newCmd(compiled), nil
+}
+
+func newCmd(binary string) *Cmd {
+	return &Cmd{Binary: binary, server: make(child.Server)}
 }
 
 // Command will return a gosafe.Cmd encapsulating the given code.
 func (self *Compiler) Command(s string) (cmd *Cmd, err error) {
-	output := path.Join(os.TempDir(), fmt.Sprintf("%s.gosafe.go", self.shorten(s)))
-	file, err := os.Create(output)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		os.Remove(output)
-	}()
-	file.WriteString(s)
-	err = file.Close()
-	if err != nil {
-		return nil, err
-	}
-	return self.CommandFile(file.Name())
+	return self.CommandContext(context.Background(), s)
+}
+
+// CommandContext will return a gosafe.Cmd encapsulating the given code, and stop checking and compiling it when ctx is done.
+func (self *Compiler) CommandContext(ctx context.Context, s string) (cmd *Cmd, err error) {
+	return self.CommandSourceContext(ctx, "main.go", []byte(s))
 }
 
 // Compile will compile the given file to a temporary file if deemed safe, and return the path to the resulting binary.
 func (self *Compiler) Compile(file string) (output string, err error) {
-	output = path.Join(os.TempDir(), fmt.Sprintf("%s.gosafe", self.shorten(file)))
-	err = self.CompileTo(file, output)
-	if err != nil {
+	return self.CompileContext(context.Background(), file)
+}
+
+// CompileContext will compile the given file to a temporary file if deemed safe, and return the path to the resulting binary.
+// When ctx is done checking and compiling stops, and all go toolchain processes are killed.
+func (self *Compiler) CompileContext(ctx context.Context, file string) (output string, err error) {
+	compiler := self.snapshot()
+	output = path.Join(os.TempDir(), fmt.Sprintf("%s.gosafe", compiler.shorten(file)))
+	if _, err = compiler.compileTo(ctx, []string{file}, nil, output, compiler.BuildOptions, func(sources map[string][]byte) ([]Violation, error) {
+		return compiler.check(ctx, []string{file}, sources)
+	}); err != nil {
 		return "", err
 	}
 	return output, nil
@@ -387,35 +954,90 @@ func (self *Compiler) Compile(file string) (output string, err error) {
 
 // CompileTo will compile the given file to a given path file if deemed safe.
 func (self *Compiler) CompileTo(file, output string) error {
-	fstat, err := os.Stat(file)
-	if err != nil {
-		// Problem stating file
-		return err
+	compiler := self.snapshot()
+	ctx := context.Background()
+	_, err := compiler.compileTo(ctx, []string{file}, nil, output, compiler.BuildOptions, func(sources map[string][]byte) ([]Violation, error) {
+		return compiler.check(ctx, []string{file}, sources)
+	})
+	return err
+}
+
+// CompileToWith will compile the given file to a given path file if deemed safe, using options instead of the BuildOptions of this gosafe.Compiler,
+// and describe the result.
+func (self *Compiler) CompileToWith(file, output string, options BuildOptions) (*BuildResult, error) {
+	return self.CompileToContext(context.Background(), file, output, options)
+}
+
+// CompileToContext will compile the given file to a given path file if deemed safe, using options instead of the BuildOptions of this
+// gosafe.Compiler, and describe the result. When ctx is done checking and compiling stops, and all go toolchain processes are killed.
+func (self *Compiler) CompileToContext(ctx context.Context, file, output string, options BuildOptions) (*BuildResult, error) {
+	compiler := self.snapshot()
+	return compiler.compileTo(ctx, []string{file}, nil, output, options, func(sources map[string][]byte) ([]Violation, error) {
+		return compiler.check(ctx, []string{file}, sources)
+	})
+}
+
+// compileTo builds the program in files with options to output if check accepts their contents, unless ctx is done.
+// The contents are taken from sources if present there and otherwise read from disk once, and the same contents are checked, keyed and built.
+// The files are built in a throwaway module, where all replaced packages are available, unless the binary is cached in CacheDir already.
+func (self *Compiler) compileTo(ctx context.Context, files []string, sources map[string][]byte, output string, options BuildOptions, check func(sources map[string][]byte) ([]Violation, error)) (result *BuildResult, err error) {
+	if err = options.validate(); err != nil {
+		return nil, err
 	}
-	if compileTime, ok := self.okCompiled[file]; ok && compileTime.After(fstat.ModTime()) {
-		// Was compiled before, and after the file was last changed
-		return nil
+	if sources, err = readSources(files, sources); err != nil {
+		return nil, err
 	}
-	err = self.Check(file)
+	warnings, err := check(sources)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var stderr bytes.Buffer
-	var stdout bytes.Buffer
-	args := []string{"build", "-ldflags", fmt.Sprint("-o ", output), file}
-	cmd := exec.Command("go", args...)
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stdout
-	err = cmd.Run()
-	if len((stderr).Bytes()) > 0 {
-		return Error(string(stderr.Bytes()))
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if output, err = filepath.Abs(output); err != nil {
+		return nil, err
 	}
-	if len((stdout).Bytes()) > 0 {
-		return Error(string(stdout.Bytes()))
+	result = &BuildResult{Output: output, Warnings: warnings}
+	if result.Toolchain, err = self.toolchainVersion(ctx); err != nil {
+		return nil, err
+	}
+	if result.Env, err = self.buildEnv(options); err != nil {
+		return nil, err
 	}
+	key, err := self.compileKey(ctx, files, sources, options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	self.okCompiled[file] = time.Now()
-	return nil
+	self.cacheLock.Lock()
+	compiled := self.okCompiled[output] == key
+	self.cacheLock.Unlock()
+	if compiled {
+		if _, err = os.Stat(output); err == nil {
+			// Built by this gosafe.Compiler, and still there
+			progress(ctx, Cached)
+			result.Cached = true
+			return result, nil
+		}
+	}
+	if result.Cached, err = self.loadCached(key, output); err != nil {
+		return nil, err
+	}
+	if result.Cached {
+		progress(ctx, Cached)
+	} else {
+		if err = self.buildShared(ctx, key, files, sources, options, result.Env, output); err != nil {
+			var compileErr *CompileError
+			if errors.As(err, &compileErr) {
+				return nil, compileErr.rename(func(printed string) string {
+					return self.sourceName(files, printed)
+				})
+			}
+			return nil, err
+		}
+	}
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	makeRoom(self.okCompiled)
+	self.okCompiled[output] = key
+	return result, nil
 }
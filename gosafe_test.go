@@ -2,13 +2,22 @@ package gosafe
 
 import (
 	"bytes"
-	"github.com/zond/tools"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"reflect"
+	"runtime"
 	"strings"
 	"math"
 	"testing"
+	"time"
 )
 
 func compileTest(t *testing.T, c *Compiler, file string, work bool) {
@@ -54,8 +63,6 @@ func runFileTest(t *testing.T, c *Compiler, f string, work bool, stdin, stdout s
 }
 
 func runTest(t *testing.T, c *Compiler, data string, work bool, stdin, stdout string, file bool) {
-	tools.TimeIn("runTest")
-	defer tools.TimeOut("runTest")
 	var cmd *Cmd
 	var err error
 	if file {
@@ -112,7 +119,6 @@ func TestAllowedRunString(t *testing.T) {
 }
 
 func TestSpeedString(t *testing.T) {
-	tools.TimeClear()
 	c := NewCompiler()
 	c.Allow("fmt")
 	n := 10
@@ -123,7 +129,6 @@ func TestSpeedString(t *testing.T) {
 }
 
 func TestSpeed(t *testing.T) {
-	tools.TimeClear()
 	c := NewCompiler()
 	c.Allow("fmt")
 	n := 10
@@ -154,7 +159,7 @@ func mapTest(t *testing.T, i1, i2 interface{}) {
 
 func TestHandling(t *testing.T) {
 	c := NewCompiler()
-	c.Allow("../child")
+	c.Allow(ChildPackage)
 	s := "testdata/test3.go"
 	cmd, err := c.CommandFile(s)
 	if err == nil {
@@ -210,7 +215,7 @@ func continuousHandleTest(t *testing.T, cmd *Cmd, ti interface{}, ni map[interfa
 
 func TestContinuousHandling(t *testing.T) {
 	c := NewCompiler()
-	c.Allow("../child")
+	c.Allow(ChildPackage)
 	c.Allow("math/rand")
 	c.Allow("time")
 	c.Allow("fmt")
@@ -280,7 +285,7 @@ func sin(args... interface{}) interface{} {
 func TestChildServer(t *testing.T) {
 	c := NewCompiler()
 	c.Allow("math")
-	c.Allow("../child")
+	c.Allow(ChildPackage)
 	f := "testdata/test5.go"
 	cmd, err := c.CommandFile(f)
 	if err == nil {
@@ -319,7 +324,7 @@ func TestGosafety(t *testing.T) {
 	c.Allow("time")
 	c.Allow("os")
 	c.Allow("fmt")
-	c.Allow("../child")
+	c.Allow(ChildPackage)
 	f := "testdata/test3.go"
 	cmd, err := c.RunFile(f)
 	if err == nil {
@@ -371,7 +376,11 @@ func TestAllowedC(t *testing.T) {
 	c := NewCompiler()
 	c.Allow("fmt")
 	c.Allow("C")
-	compileTest(t, c, "testdata/test2.go", true)
+	if err := c.Check("testdata/test2.go"); err != nil {
+		t.Error("testdata/test2.go should pass with C allowed, but got", err)
+	}
+	// cgo is disabled when building
+	compileTest(t, c, "testdata/test2.go", false)
 }
 
 func TestDisallowedC(t *testing.T) {
@@ -379,3 +388,1235 @@ func TestDisallowedC(t *testing.T) {
 	c.Allow("fmt")
 	compileTest(t, c, "testdata/test2.go", false)
 }
+
+func TestCheckError(t *testing.T) {
+	c := NewCompiler()
+	_, err := c.Compile("testdata/test1.go")
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) == 1 {
+			violation := checkErr.Violations[0]
+			if violation.Kind != DisallowedImport || violation.ImportPath != "fmt" {
+				t.Error("testdata/test1.go should violate", DisallowedImport, "of fmt, but got", violation)
+			}
+			if violation.Pos.Filename != "testdata/test1.go" || violation.Pos.Line != 5 || violation.Pos.Column != 2 {
+				t.Error("testdata/test1.go should violate at testdata/test1.go:5:2, but got", violation.Pos)
+			}
+			if len(checkErr.ByKind()[DisallowedImport]) != 1 {
+				t.Error("testdata/test1.go should have one", DisallowedImport, "but got", checkErr.ByKind())
+			}
+		} else {
+			t.Error("testdata/test1.go should have one violation, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error("testdata/test1.go should give a *CheckError, but got", err)
+	}
+	s := "package main\nimport (\n\t\"fmt\"\n\t\"os\"\n)\nfunc main() { fmt.Fprint(os.Stdout, \"teststring\") }\n"
+	c.Allow("fmt")
+	_, err = c.Run(s)
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].ImportPath != "os" || checkErr.Violations[0].Pos.Line != 4 {
+			t.Error(s, "should violate by importing os on line 4, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(s, "should give a *CheckError, but got", err)
+	}
+}
+
+func TestDisallowedDirectives(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.Allow("unsafe")
+	f := "testdata/test6.go"
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		violations := checkErr.ByKind()[DisallowedDirective]
+		if len(checkErr.Violations) != 2 || len(violations) != 2 || violations[0].Pos.Line != 10 || violations[1].Pos.Line != 13 {
+			t.Error(f, "should violate with //go:linkname on line 10 and //go:noinline on line 13, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Allow("unsafe")
+	c.AllowDirective("linkname")
+	c.AllowDirective("noinline")
+	if err = c.Check(f); err != nil {
+		t.Error(f, "should pass when allowing linkname and noinline, but got", err)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.Allow("reflect")
+	c.AllowSymbol("os", "Getenv")
+	c.DenySymbol("reflect", "Value.Set*")
+	f := "testdata/test7.go"
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		violations := checkErr.ByKind()[DisallowedSymbol]
+		if len(checkErr.Violations) != 2 || len(violations) != 2 {
+			t.Error(f, "should have two", DisallowedSymbol, "violations, but got", checkErr.Violations)
+		} else {
+			if violations[0].ImportPath != "reflect" || violations[0].Pos.Line != 11 {
+				t.Error(f, "should violate by using reflect.Value.SetInt on line 11, but got", violations[0])
+			}
+			if violations[1].ImportPath != "os" || violations[1].Pos.Line != 12 {
+				t.Error(f, "should violate by using os.Args on line 12, but got", violations[1])
+			}
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Allow("reflect")
+	c.AllowSymbol("os", "Getenv")
+	c.AllowSymbol("os", "Args")
+	if err = c.Check(f); err != nil {
+		t.Error(f, "should pass when allowing os.Getenv and os.Args, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Allow("reflect")
+	c.DenySymbol("reflect", "Value.Set*")
+	f = "testdata/test19.go"
+	err = c.Check(f)
+	if errors.As(err, &checkErr) {
+		lines := []int{}
+		for _, violation := range checkErr.ByKind()[DisallowedSymbol] {
+			lines = append(lines, violation.Pos.Line)
+		}
+		if len(checkErr.Violations) != 3 || fmt.Sprint(lines) != "[18 21 22]" {
+			t.Error(f, "should violate by converting reflect.Value to interfaces with SetInt on lines 18, 21 and 22, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	// Types that can't be reached from the allowed symbols can't be asserted from interfaces
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.AllowSymbol("os", "Getenv")
+	src := []byte("package main\nimport (\n\"fmt\"\n\"os\"\n)\nfunc main() {\nvar x any = fmt.Errorf(\"%v\", os.Getenv(\"HOME\"))\nif err, ok := x.(error); ok {\nfmt.Println(err)\n}\nif s, ok := x.(fmt.Stringer); ok {\nfmt.Println(s)\n}\n}\n")
+	if err = c.CheckSource("assert.go", src); err != nil {
+		t.Error("assert.go should pass when asserting error and fmt.Stringer, but got", err)
+	}
+}
+
+func TestVerifyDependencies(t *testing.T) {
+	c := NewCompiler()
+	c.Replace("gosafe.test/evil", "testdata/evil")
+	c.Allow("gosafe.test/evil")
+	f := "testdata/test8.go"
+	if err := c.Check(f); err != nil {
+		t.Error(f, "should pass without VerifyDependencies, but got", err)
+	}
+	c.VerifyDependencies = true
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != DisallowedDependency || checkErr.Violations[0].ImportPath != "os/exec" {
+			t.Error(f, "should violate by depending on os/exec, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError with VerifyDependencies, but got", err)
+	}
+	c = NewCompiler()
+	c.Replace("gosafe.test/evil", "testdata/evil")
+	c.Trust("gosafe.test/evil")
+	c.VerifyDependencies = true
+	if err := c.Check(f); err != nil {
+		t.Error(f, "should pass when trusting ./evil, but got", err)
+	}
+	c.Deny("os/exec")
+	if err := c.Check(f); !errors.As(err, &checkErr) || checkErr.Violations[0].Kind != DisallowedDependency {
+		t.Error(f, "should violate when denying os/exec, but got", err)
+	}
+}
+
+func TestReplacedFiles(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.Replace("gosafe.test/asm", "testdata/asm")
+	c.Allow("gosafe.test/asm")
+	defer c.Close()
+	f := "testdata/test20.go"
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != DisallowedFile || !strings.HasSuffix(checkErr.Violations[0].Pos.Filename, "testdata/asm/add.s") {
+			t.Error(f, "should violate by using testdata/asm/add.s, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	c.Trust("gosafe.test/asm")
+	if err = c.Check(f); err != nil {
+		t.Error(f, "should pass when trusting gosafe.test/asm, but got", err)
+	}
+	if runtime.GOARCH == "amd64" {
+		cmd, err := c.CommandFile(f)
+		if err == nil {
+			cmd.Start()
+		}
+		cmdTest(t, cmd, err, f, true, "", "3")
+	}
+}
+
+func TestDirs(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	d := "testdata/dir1"
+	if err := c.CheckDir(d); err == nil {
+		t.Error(d, "should not pass without allowing strings")
+	}
+	c.Allow("strings")
+	c.GOOS = "linux"
+	cmd, err := c.RunDir(d)
+	cmdTest(t, cmd, err, d, true, "", "dir1.go")
+	// Files are selected for the platform and build tags built for
+	var checkErr *CheckError
+	for _, platform := range []struct {
+		goos string
+		tags []string
+		file string
+	}{
+		{"windows", nil, "testdata/dir1/exit_windows.go"},
+		{"linux", []string{"loud"}, "testdata/dir1/loud.go"},
+	} {
+		c.GOOS = platform.goos
+		c.BuildOptions.Tags = platform.tags
+		err = c.CheckDir(d)
+		if errors.As(err, &checkErr) {
+			if len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != DisallowedImport || checkErr.Violations[0].Pos.Filename != platform.file {
+				t.Error(d, "should violate by importing os in", platform.file, "but got", checkErr.Violations)
+			}
+		} else {
+			t.Error(d, "should give a *CheckError for", platform.goos, platform.tags, "but got", err)
+		}
+	}
+	c.GOOS = "linux"
+	c.BuildOptions.Tags = nil
+	d = "testdata/dir2"
+	err = c.CheckDir(d)
+	if errors.As(err, &checkErr) {
+		violations := checkErr.ByKind()[DisallowedFile]
+		if len(violations) != 2 || violations[0].Pos.Filename != "testdata/dir2/add.s" || violations[1].Pos.Filename != "testdata/dir2/main_test.go" {
+			t.Error(d, "should violate by containing add.s and main_test.go, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(d, "should give a *CheckError, but got", err)
+	}
+}
+
+func TestTypeCheck(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.TypeCheck = true
+	f := "testdata/test9.go"
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 2 || checkErr.Violations[0].Kind != DisallowedImport || checkErr.Violations[1].Kind != TypeError || checkErr.Violations[1].Pos.Line != 9 {
+			t.Error(f, "should violate by importing os and by a type error on line 9, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	// Imports are resolved for the platform built for
+	c = NewCompiler()
+	c.Allow("syscall")
+	c.TypeCheck = true
+	c.GOOS = "linux"
+	src := []byte("package main\nimport \"syscall\"\nfunc main() { syscall.Kill(0, 0) }\n")
+	if err = c.CheckSource("kill.go", src); err != nil {
+		t.Error("kill.go should type check for linux, but got", err)
+	}
+	c.GOOS = "windows"
+	err = c.CheckSource("kill.go", src)
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != TypeError || checkErr.Violations[0].Pos.Line != 3 {
+			t.Error("kill.go should violate by a type error on line 3 for windows, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error("kill.go should give a *CheckError for windows, but got", err)
+	}
+}
+
+func noGoStatements(fset *token.FileSet, file *ast.File, info *types.Info) (violations []Violation) {
+	ast.Inspect(file, func(node ast.Node) bool {
+		if _, ok := node.(*ast.GoStmt); ok {
+			violations = append(violations, Violation{Pos: fset.Position(node.Pos()), Message: "No go statements allowed"})
+		}
+		return true
+	})
+	return violations
+}
+
+func TestImportCache(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Counts the go lists
+	toolchain := dir + "/go"
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = list ]; then echo list >> %v/lists; fi\nexec %v \"$@\"\n", dir, gobin)
+	if err = ioutil.WriteFile(toolchain, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompiler()
+	c.Toolchain = toolchain
+	c.Allow("fmt")
+	c.TypeCheck = true
+	lists := func() int {
+		b, _ := ioutil.ReadFile(dir + "/lists")
+		return strings.Count(string(b), "list")
+	}
+	for index, s := range []string{
+		"package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"a\") }\n",
+		"package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"b\") }\n",
+	} {
+		if err = c.CheckSource("main.go", []byte(s)); err != nil {
+			t.Error(s, "should pass, but got", err)
+		}
+		if lists() != 1 {
+			t.Error(s, "should be type checked with export data listed once, but go list ran", lists(), "times after", index+1, "checks")
+		}
+	}
+	// Another platform needs other export data
+	c.GOOS = "windows"
+	if err = c.CheckSource("main.go", []byte("package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"c\") }\n")); err != nil {
+		t.Error("should pass for windows, but got", err)
+	}
+	if lists() != 2 {
+		t.Error("should list export data again for windows, but go list ran", lists(), "times")
+	}
+}
+
+func TestRules(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	f := "testdata/test10.go"
+	if err := c.Check(f); err != nil {
+		t.Error(f, "should pass without rules, but got", err)
+	}
+	c.AddRule(RuleFunc(noGoStatements))
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != RuleViolation || checkErr.Violations[0].Pos.Line != 9 {
+			t.Error(f, "should violate by a go statement on line 9, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError after adding a rule, but got", err)
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	config := `{
+  "use": "tenant",
+  "profiles": {
+    "base": {"allow": ["fmt"], "deny": ["unsafe"], "allowSymbols": {"os": ["Getenv"]}},
+    "tenant": {"inherits": ["base"], "allow": ["strings"], "typeCheck": true}
+  }
+}`
+	c, err := NewCompilerFromConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(config, "should be a valid policy, but got", err)
+	}
+	policy := c.Policy()
+	if !reflect.DeepEqual(policy.Allow, []string{"fmt", "strings"}) || !reflect.DeepEqual(policy.Deny, []string{"unsafe"}) || !reflect.DeepEqual(policy.AllowSymbols, map[string][]string{"os": []string{"Getenv"}}) || !policy.TypeCheck {
+		t.Error(config, "should give a policy with the tenant profile including what it inherits, but got", policy)
+	}
+	if err = c.Check("testdata/test1.go"); err != nil {
+		t.Error("testdata/test1.go should pass with", config, "but got", err)
+	}
+	buffer := new(bytes.Buffer)
+	if err = c.DumpPolicy(buffer); err != nil {
+		t.Fatal("should be able to dump the policy, but got", err)
+	}
+	dumped, err := NewCompilerFromConfig(buffer)
+	if err != nil {
+		t.Fatal("should be able to load the dumped policy, but got", err)
+	}
+	if !reflect.DeepEqual(dumped.Policy(), policy) {
+		t.Error("loading the dumped policy", policy, "should give the same policy, but got", dumped.Policy())
+	}
+	for _, bad := range []string{
+		`{"allow": ["runtime"]}`,
+		`{"alow": ["fmt"]}`,
+		`{"use": "a", "profiles": {"a": {"inherits": ["b"]}, "b": {"inherits": ["a"]}}}`,
+	} {
+		if _, err = NewCompilerFromConfig(strings.NewReader(bad)); err == nil {
+			t.Error(bad, "should not be a valid policy")
+		}
+	}
+}
+
+// presetForbidden are the packages whose types must never be reachable through the API of a Preset.
+var presetForbidden = map[string]bool{
+	"os":            true,
+	"os/exec":       true,
+	"os/signal":     true,
+	"io/fs":         true,
+	"net":           true,
+	"net/http":      true,
+	"syscall":       true,
+	"plugin":        true,
+	"unsafe":        true,
+	"runtime":       true,
+	"runtime/debug": true,
+}
+
+// presetLeak returns a forbidden package reachable through typ without using the symbols denied by preset, or the empty string.
+func presetLeak(preset Preset, typ types.Type, seen map[types.Type]bool) string {
+	if seen[typ] {
+		return ""
+	}
+	seen[typ] = true
+	switch typ := typ.(type) {
+	case *types.Basic:
+		if typ.Kind() == types.UnsafePointer {
+			return "unsafe"
+		}
+	case *types.Named:
+		if typ.Obj().Pkg() != nil && presetForbidden[typ.Obj().Pkg().Path()] {
+			return typ.Obj().Pkg().Path()
+		}
+		for i := 0; i < typ.NumMethods(); i++ {
+			denied := false
+			if typ.Obj().Pkg() != nil {
+				for _, name := range preset.DenySymbols[typ.Obj().Pkg().Path()] {
+					denied = denied || name == fmt.Sprint(typ.Obj().Name(), ".", typ.Method(i).Name())
+				}
+			}
+			if typ.Method(i).Exported() && !denied {
+				if leak := presetLeak(preset, typ.Method(i).Type(), seen); leak != "" {
+					return leak
+				}
+			}
+		}
+		return presetLeak(preset, typ.Underlying(), seen)
+	case *types.Pointer:
+		return presetLeak(preset, typ.Elem(), seen)
+	case *types.Slice:
+		return presetLeak(preset, typ.Elem(), seen)
+	case *types.Array:
+		return presetLeak(preset, typ.Elem(), seen)
+	case *types.Chan:
+		return presetLeak(preset, typ.Elem(), seen)
+	case *types.Map:
+		if leak := presetLeak(preset, typ.Key(), seen); leak != "" {
+			return leak
+		}
+		return presetLeak(preset, typ.Elem(), seen)
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{typ.Params(), typ.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				if leak := presetLeak(preset, tuple.At(i).Type(), seen); leak != "" {
+					return leak
+				}
+			}
+		}
+	case *types.Struct:
+		for i := 0; i < typ.NumFields(); i++ {
+			if typ.Field(i).Exported() {
+				if leak := presetLeak(preset, typ.Field(i).Type(), seen); leak != "" {
+					return leak
+				}
+			}
+		}
+	case *types.Interface:
+		for i := 0; i < typ.NumMethods(); i++ {
+			if typ.Method(i).Exported() {
+				if leak := presetLeak(preset, typ.Method(i).Type(), seen); leak != "" {
+					return leak
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func TestPresets(t *testing.T) {
+	output, err := exec.Command("go", "list", "std").Output()
+	if err != nil {
+		t.Fatal("should be able to list the standard library, but got", err)
+	}
+	std := make(map[string]bool)
+	for _, p := range strings.Fields(string(output)) {
+		std[p] = true
+	}
+	imp := importer.ForCompiler(token.NewFileSet(), "gc", nil)
+	for _, preset := range Presets {
+		if found, err := LookupPreset(preset.Name); err != nil || found.Name != preset.Name {
+			t.Error(preset.Name, "should be found by LookupPreset, but got", found, err)
+		}
+		for _, p := range preset.Packages {
+			if !std[p] {
+				t.Error(preset.Name, "contains", p, "which is not in the standard library")
+				continue
+			}
+			if presetForbidden[p] {
+				t.Error(preset.Name, "contains the forbidden package", p)
+			}
+			pkg, err := imp.Import(p)
+			if err != nil {
+				t.Error(preset.Name, "contains", p, "which should be importable, but got", err)
+				continue
+			}
+			seen := make(map[types.Type]bool)
+			for _, name := range pkg.Scope().Names() {
+				if obj := pkg.Scope().Lookup(name); obj.Exported() {
+					if leak := presetLeak(preset, obj.Type(), seen); leak != "" {
+						t.Error(preset.Name, "contains", p, "which exposes", leak, "through", obj)
+					}
+				}
+			}
+		}
+	}
+	c, err := NewCompilerFromConfig(strings.NewReader(`{"presets": ["pure-compute/v1"]}`))
+	if err != nil {
+		t.Fatal("should be able to use presets in policies, but got", err)
+	}
+	if !reflect.DeepEqual(c.Policy().Allow, PresetPureComputeV1.Packages) {
+		t.Error("using", PresetPureComputeV1.Name, "should allow", PresetPureComputeV1.Packages, "but allowed", c.Policy().Allow)
+	}
+	c = NewCompiler()
+	c.AllowPreset(PresetEncodingV1)
+	f := "testdata/test11.go"
+	var checkErr *CheckError
+	if err := c.Check(f); !errors.As(err, &checkErr) || len(checkErr.Violations) != 1 || checkErr.Violations[0].Kind != DisallowedSymbol {
+		t.Error(f, "should violate by using reflect.Value.UnsafePointer, but got", err)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("encoding/...")
+	c.Deny("encoding/gob")
+	f := "testdata/test12.go"
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 2 {
+			t.Error(f, "should violate by importing encoding/gob and fmt, but got", checkErr.Violations)
+		} else {
+			if checkErr.Violations[0].ImportPath != "encoding/gob" || checkErr.Violations[0].Rule != `deny "encoding/gob"` {
+				t.Error(f, "should violate by importing the denied encoding/gob, but got", checkErr.Violations[0])
+			}
+			if checkErr.Violations[1].ImportPath != "fmt" || checkErr.Violations[1].Rule != "no allow rule" {
+				t.Error(f, "should violate by importing the not allowed fmt, but got", checkErr.Violations[1])
+			}
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	for p, wanted := range map[string]string{
+		"encoding":      `allow "encoding/..."`,
+		"encoding/json": `allow "encoding/..."`,
+		"encoding/gob":  `deny "encoding/gob"`,
+		"encodingx":     "no allow rule",
+	} {
+		if _, rule := c.Explain(p); rule != wanted {
+			t.Error(p, "should be decided by", wanted, "but got", rule)
+		}
+	}
+	c.Allow("...")
+	if allowed, rule := c.Explain("runtime"); allowed {
+		t.Error("runtime should not be allowed by patterns, but got", rule)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	f := "testdata/test13.go"
+	_, err := c.Compile(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		violations := checkErr.ByKind()[SyntaxError]
+		if len(violations) < 2 || len(violations) != len(checkErr.Violations) || violations[0].Pos.Line != 9 {
+			t.Error(f, "should give only syntax errors, starting on line 9, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError, but got", err)
+	}
+	c.PartialCheck = true
+	if err = c.Check(f); errors.As(err, &checkErr) {
+		if len(checkErr.ByKind()[SyntaxError]) < 2 || len(checkErr.ByKind()[DisallowedImport]) != 1 {
+			t.Error(f, "should give both syntax errors and the import of os with PartialCheck, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError with PartialCheck, but got", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	f := "testdata/test14.go"
+	if err := c.Check(f); err != nil {
+		t.Error(f, "should pass without limits, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Limits = Limits{
+		MaxDepth:             40,
+		MaxLiteralBytes:      256,
+		MaxCompositeElements: 100,
+		MaxDecls:             3,
+	}
+	err := c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		rules := make(map[string]bool)
+		for _, violation := range checkErr.ByKind()[LimitExceeded] {
+			rules[violation.Rule] = true
+		}
+		if len(rules) != 4 || len(checkErr.Violations) != 4 || !rules["MaxDepth"] || !rules["MaxLiteralBytes"] || !rules["MaxCompositeElements"] || !rules["MaxDecls"] {
+			t.Error(f, "should exceed MaxDepth, MaxLiteralBytes, MaxCompositeElements and MaxDecls, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError with limits, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Limits.MaxSourceBytes = 100
+	if err = c.Check(f); !errors.As(err, &checkErr) || len(checkErr.Violations) != 1 || checkErr.Violations[0].Rule != "MaxSourceBytes" {
+		t.Error(f, "should exceed MaxSourceBytes, but got", err)
+	}
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.Limits.MaxNodes = 100
+	if err = c.Check(f); !errors.As(err, &checkErr) || len(checkErr.Violations) != 1 || checkErr.Violations[0].Rule != "MaxNodes" {
+		t.Error(f, "should exceed MaxNodes, but got", err)
+	}
+}
+
+func TestBuildLimits(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	f := "testdata/test1.go"
+	// Cached binaries wouldn't be built at all
+	c.CacheDir = ""
+	c.BuildTimeout = time.Millisecond
+	if _, err := c.Compile(f); !errors.Is(err, ErrCompileLimit) {
+		t.Error(f, "should hit BuildTimeout, but got", err)
+	}
+	c.BuildTimeout = DefaultBuildTimeout
+	c.BuildMemory = 1 << 20
+	if _, err := c.Compile(f); !errors.Is(err, ErrCompileLimit) {
+		t.Error(f, "should hit BuildMemory, but got", err)
+	}
+	c.BuildMemory = 1 << 34
+	c.BuildCPU = time.Minute
+	if _, err := c.Compile(f); err != nil {
+		t.Error(f, "should build within generous limits, but got", err)
+	}
+}
+
+func TestGas(t *testing.T) {
+	c := NewCompiler()
+	c.Allow(ChildPackage)
+	c.Gas = 100000
+	f := "testdata/test15.go"
+	cmd, err := c.CommandFile(f)
+	if err != nil {
+		t.Fatal(f, "should compile with Gas, but got", err)
+	}
+	defer cmd.Kill()
+	for _, name := range []string{"spin", "jump"} {
+		if _, err = cmd.Call(name); err == nil || !strings.Contains(err.Error(), "Out of gas") {
+			t.Error(f, "should run out of gas calling", name, "but got", err)
+		}
+	}
+	pid, _ := cmd.Pid()
+	if response, err := cmd.Call("sum", 1.0, 2.0); err != nil || response != 3.0 {
+		t.Error(f, "should still sum 1 and 2 after running out of gas, but got", response, err)
+	}
+	if newPid, _ := cmd.Pid(); newPid != pid {
+		t.Error(f, "should keep running after running out of gas, but was restarted")
+	}
+	// Goroutines started by a Request can't outlive its gas
+	called := make(chan error)
+	go func() {
+		_, err := cmd.Call("spawn")
+		called <- err
+	}()
+	select {
+	case err = <-called:
+		if err == nil || !strings.Contains(err.Error(), "Out of gas") {
+			t.Error(f, "should run out of gas in a goroutine calling spawn, but got", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal(f, "should run out of gas in a goroutine calling spawn, but the call never returned")
+	}
+	if response, err := cmd.Call("sum", 1.0, 2.0); err != nil || response != 3.0 {
+		t.Error(f, "should sum 1 and 2 after running out of gas in a goroutine, but got", response, err)
+	}
+	// Nor spend the gas of the next Request
+	cmd.Call("leak")
+	if response, err := cmd.Call("count", 90000.0); err != nil || response != 90000.0 {
+		t.Error(f, "should count to 90000 after leaking a goroutine, but got", response, err)
+	}
+	// Checked code can't turn the metering off, spend gas itself or handle Requests with a full tank
+	c.Gas = 1000
+	for _, s := range []string{
+		"package main\nimport \"github.com/zond/gosafe/child\"\nfunc main() { child.SetGas(0) }\n",
+		"package main\nimport c \"github.com/zond/gosafe/child\"\nfunc main() { c.Step() }\n",
+		"package main\nimport . \"github.com/zond/gosafe/child\"\nfunc main() { Step() }\n",
+		"package main\nimport \"github.com/zond/gosafe/child\"\nfunc noop(args ...interface{}) interface{} { return nil }\nfunc main() { s := child.Server{\"noop\": noop}; for { s.Handle(child.Request{Name: \"noop\"}) } }\n",
+		"package main\nimport \"github.com/zond/gosafe/child\"\nfunc main() { handle := child.Server.Handle; handle(child.NewServer(), child.Request{}) }\n",
+		"package main\nimport \"github.com/zond/gosafe/child\"\ntype handler interface { Handle(child.Request) child.Response }\nfunc main() { var h handler = child.NewServer(); h.Handle(child.Request{}) }\n",
+	} {
+		if _, err = c.Command(s); err == nil {
+			t.Error(s, "should not compile with Gas")
+		}
+	}
+	// Errors are reported at the lines of the original file
+	var compileErr *CompileError
+	if _, err = c.Compile("testdata/test18.go"); errors.As(err, &compileErr) {
+		if len(compileErr.Diagnostics) != 2 || compileErr.Diagnostics[0].File != "testdata/test18.go" || compileErr.Diagnostics[0].Line != 4 || compileErr.Diagnostics[1].Line != 5 {
+			t.Error("testdata/test18.go should give errors at lines 4 and 5 with Gas, but got", compileErr.Diagnostics)
+		}
+	} else {
+		t.Error("testdata/test18.go should give a *CompileError with Gas, but got", err)
+	}
+}
+
+func TestAnalyzers(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	for _, analyzer := range VetAnalyzers {
+		c.EnableAnalyzer(analyzer, Warning)
+	}
+	f := "testdata/test16.go"
+	compileTest(t, c, f, true)
+	warnings, err := c.CheckWarnings(f)
+	if err != nil || len(warnings) != 2 || warnings[0].Rule != "printf" || warnings[0].Pos.Line != 8 || warnings[1].Rule != "unreachable" || warnings[1].Pos.Line != 10 {
+		t.Error(f, "should give printf and unreachable warnings, but got", warnings, err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-analyzers-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if result, err := c.CompileToWith(f, dir+"/test16.gosafe", BuildOptions{}); err != nil || len(result.Warnings) != 2 {
+		t.Error(f, "should compile with printf and unreachable warnings, but got", result, err)
+	}
+	src, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings, err = c.CheckSourceWarnings("user.go", src); err != nil || len(warnings) != 2 || warnings[0].Pos.Filename != "user.go" {
+		t.Error(f, "should give printf and unreachable warnings in user.go, but got", warnings, err)
+	}
+	c.EnableAnalyzer(VetAnalyzers[1], Blocking)
+	err = c.Check(f)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 2 || checkErr.Violations[0].Severity != Warning || checkErr.Violations[1].Severity != Blocking {
+			t.Error(f, "should give a printf warning and a blocking unreachable violation, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error(f, "should give a *CheckError with a blocking analyzer, but got", err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	defer c.Close()
+	bad := []byte("package main\nimport \"os\"\nfunc main() { os.Exit(1) }\n")
+	err := c.CheckSource("user.go", bad)
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		if len(checkErr.Violations) != 1 || checkErr.Violations[0].Pos.Filename != "user.go" || checkErr.Violations[0].Pos.Line != 2 {
+			t.Error("checking", string(bad), "should give a violation in user.go on line 2, but got", checkErr.Violations)
+		}
+	} else {
+		t.Error("checking", string(bad), "should give a *CheckError, but got", err)
+	}
+	if _, err = c.CommandSource("user.go", bad); !errors.As(err, &checkErr) {
+		t.Error(string(bad), "should not compile, but got", err)
+	}
+	good := "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testsource\") }\n"
+	cmd, err := c.CommandSource("user.go", []byte(good))
+	if err == nil {
+		if !strings.HasPrefix(cmd.Binary, c.workDir) {
+			t.Error(good, "should be built in the work directory", c.workDir, "but was built to", cmd.Binary)
+		}
+		cmd.Start()
+		cmdTest(t, cmd, err, good, true, "", "testsource")
+	} else {
+		t.Error(good, "should compile, but got", err)
+	}
+	// Only the binary is kept once built
+	if entries, err := ioutil.ReadDir(c.workDir); err != nil || len(entries) != 1 || entries[0].IsDir() {
+		t.Error(good, "should leave only its binary in the work directory, but got", entries, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "gosafe-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	s := "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testcache\") }\n"
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.CacheDir = cacheDir
+	if _, err = c.Command(s); err != nil {
+		t.Fatal(s, "should compile, but got", err)
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatal(s, "should be cached in", cacheDir, "but got", entries, err)
+	}
+	c.Close()
+	// A new Compiler with the same policy uses the cache instead of building, which would fail within this timeout
+	c = NewCompiler()
+	c.Allow("fmt")
+	c.CacheDir = cacheDir
+	// Checking asks the toolchain for its version, which is part of the cache key
+	if err = c.CheckSource("main.go", []byte(s)); err != nil {
+		t.Fatal(s, "should pass, but got", err)
+	}
+	c.BuildTimeout = time.Nanosecond
+	cmd, err := c.Command(s)
+	if err == nil {
+		cmd.Start()
+		cmdTest(t, cmd, err, s, true, "", "testcache")
+	} else {
+		t.Error(s, "should be loaded from the cache, but got", err)
+	}
+	c.Close()
+	c.Allow("strings")
+	if _, err = c.Command(s); !errors.Is(err, ErrCompileLimit) {
+		t.Error(s, "should be built again with a different policy, but got", err)
+	}
+	// The least recently used binary is evicted when the cache grows too big
+	c.BuildTimeout = DefaultBuildTimeout
+	c.CacheSize = entries[0].Size() * 3 / 2
+	if _, err = c.Command(s); err != nil {
+		t.Fatal(s, "should compile, but got", err)
+	}
+	if newEntries, err := ioutil.ReadDir(cacheDir); err != nil || len(newEntries) != 1 || newEntries[0].Name() == entries[0].Name() {
+		t.Error(cacheDir, "should only contain the newest binary, but got", newEntries, err)
+	}
+	c.Close()
+}
+
+func TestConcurrency(t *testing.T) {
+	c := NewCompiler()
+	c.Allow("fmt")
+	// Build every time, one go build at a time
+	c.CacheDir = ""
+	c.MaxBuilds = 1
+	defer c.Close()
+	s := "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testconcurrency\") }\n"
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			c.Allow(fmt.Sprint("strings", i))
+			cmd, err := c.Command(s)
+			if err == nil {
+				var output []byte
+				if output, err = exec.Command(cmd.Binary).Output(); err == nil && string(output) != "testconcurrency" {
+					err = fmt.Errorf("got output %q", output)
+				}
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(s, "should compile and run concurrently, but got", err)
+		}
+	}
+}
+
+func TestSharedBuild(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-shared-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Counts the go builds, and makes them slow enough to overlap
+	toolchain := dir + "/go"
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = build ]; then echo build >> %v/builds; sleep 1; fi\nexec %v \"$@\"\n", dir, gobin)
+	if err = ioutil.WriteFile(toolchain, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompiler()
+	c.Toolchain = toolchain
+	c.CacheDir = ""
+	defer c.Close()
+	policy := Policy{Allow: []string{"fmt", "strings"}, DenySymbols: map[string][]string{"strings": []string{"Builder.*"}}, TypeCheck: true}
+	s := "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testsharedbuild\") }\n"
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			err := c.ApplyPolicy(policy)
+			if err == nil {
+				var cmd *Cmd
+				if cmd, err = c.Command(s); err == nil {
+					var output []byte
+					if output, err = exec.Command(cmd.Binary).Output(); err == nil && string(output) != "testsharedbuild" {
+						err = fmt.Errorf("got output %q", output)
+					}
+				}
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(s, "should compile and run concurrently with the same policy, but got", err)
+		}
+	}
+	if builds, err := ioutil.ReadFile(dir + "/builds"); err != nil || strings.Count(string(builds), "build") != 1 {
+		t.Errorf("%v with the same policy should run go build once, but got %q, %v", s, builds, err)
+	}
+}
+
+func TestSourceChange(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-change-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/main.go"
+	if err = ioutil.WriteFile(file, []byte("package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"checked\") }\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/swapped.go", []byte("package main\nimport (\"fmt\"; \"os\")\nfunc main() { fmt.Print(\"swapped\", os.Getpid()) }\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Replaces the file with code that isn't allowed while its dependencies are verified, after it was checked
+	toolchain := dir + "/go"
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = list ]; then cp %v/swapped.go %v; fi\nexec %v \"$@\"\n", dir, file, gobin)
+	if err = ioutil.WriteFile(toolchain, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompiler()
+	c.Toolchain = toolchain
+	c.CacheDir = ""
+	c.VerifyDependencies = true
+	c.Allow("fmt")
+	defer c.Close()
+	output := dir + "/main.gosafe"
+	if err = c.CompileTo(file, output); err != nil {
+		t.Fatal(file, "should compile, but got", err)
+	}
+	if out, err := exec.Command(output).Output(); err != nil || string(out) != "checked" {
+		t.Errorf("%v should be built from the checked source, but printed %q, %v", file, out, err)
+	}
+}
+
+func TestPolicyDuringBuild(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Makes the go builds slow, and tells when they started
+	toolchain := dir + "/go"
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = build ]; then touch %v/building; sleep 3; fi\nexec %v \"$@\"\n", dir, gobin)
+	if err = ioutil.WriteFile(toolchain, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompiler()
+	c.Toolchain = toolchain
+	c.CacheDir = ""
+	c.Allow("fmt")
+	defer c.Close()
+	s := "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testpolicyduringbuild\") }\n"
+	built := make(chan error)
+	go func() {
+		_, err := c.Command(s)
+		built <- err
+	}()
+	for {
+		if _, err := os.Stat(dir + "/building"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	changed := make(chan error)
+	go func() {
+		c.Allow("strings")
+		changed <- c.CheckSource("main.go", []byte("package main\nimport \"strings\"\nfunc main() { strings.ToUpper(\"a\") }\n"))
+	}()
+	select {
+	case err := <-changed:
+		if err != nil {
+			t.Error("code using the newly allowed package should pass during a build, but got", err)
+		}
+	case err := <-built:
+		t.Error("changing the policy and checking code should not wait for a running build, but the build finished first with", err)
+		<-changed
+		return
+	}
+	if err := <-built; err != nil {
+		t.Error(s, "should compile with the policy it was started with, but got", err)
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosafe-options-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := dir + "/test17.gosafe"
+	c := NewCompiler()
+	c.Allow("fmt")
+	defer c.Close()
+	c.BuildOptions = BuildOptions{
+		Trimpath: true,
+		LDFlags:  []string{"-s", "-w", "-X=main.version=testbuildoptions"},
+	}
+	if err = c.CompileTo("testdata/test17.go", output); err == nil {
+		cmd := newCmd(output)
+		cmd.Start()
+		cmdTest(t, cmd, nil, "testdata/test17.go", true, "", "testbuildoptions")
+	} else {
+		t.Error("testdata/test17.go should compile with", c.BuildOptions, "but got", err)
+	}
+	if _, err = c.CompileToWith("testdata/test17.go", output, BuildOptions{Lang: "1.21"}); err == nil {
+		t.Error("testdata/test17.go should not compile with language version 1.21")
+	}
+	for _, options := range []BuildOptions{
+		BuildOptions{GCFlags: []string{"-N -toolexec=/bin/sh"}},
+		BuildOptions{LDFlags: []string{"-X=main.version=a -extld=/bin/sh"}},
+		BuildOptions{Tags: []string{"a -overlay=/tmp/overlay.json"}},
+		BuildOptions{Lang: "1.21 -toolexec=/bin/sh"},
+		BuildOptions{GCFlags: []string{"-B"}},
+		BuildOptions{LDFlags: []string{"-X=github.com/zond/gosafe/child.OutOfGas=x"}},
+		BuildOptions{LDFlags: []string{"-X=runtime.buildVersion=x"}},
+	} {
+		if _, err = c.CompileToWith("testdata/test17.go", output, options); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Error("testdata/test17.go should not compile with", options, "but got", err)
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	// None of these should leak into the build
+	os.Setenv("CGO_ENABLED", "1")
+	os.Setenv("GOFLAGS", "-toolexec=/bin/false")
+	os.Setenv("GOPROXY", "https://proxy.golang.org")
+	defer os.Unsetenv("CGO_ENABLED")
+	defer os.Unsetenv("GOFLAGS")
+	defer os.Unsetenv("GOPROXY")
+	dir, err := ioutil.TempDir("", "gosafe-env-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCompiler()
+	c.Allow("fmt")
+	defer c.Close()
+	result, err := c.CompileToWith("testdata/test1.go", dir+"/test1.gosafe", BuildOptions{})
+	if err != nil {
+		t.Fatal("testdata/test1.go should compile, but got", err)
+	}
+	env := map[string]bool{}
+	for _, variable := range result.Env {
+		env[variable] = true
+	}
+	for _, wanted := range []string{"CGO_ENABLED=0", "GOFLAGS=-mod=mod", "GOPROXY=off", "GOENV=off", "GOTOOLCHAIN=local", "GOOS=" + runtime.GOOS, "GOARCH=" + runtime.GOARCH, "GOMODCACHE=" + c.ModCache} {
+		if !env[wanted] {
+			t.Error("testdata/test1.go should be built with", wanted, "but got", result.Env)
+		}
+	}
+	if env["CGO_ENABLED=1"] || env["GOFLAGS=-toolexec=/bin/false"] {
+		t.Error("testdata/test1.go should not be built with the environment of the parent, but got", result.Env)
+	}
+	if result, err = c.CompileToWith("testdata/test1.go", dir+"/test1.gosafe", BuildOptions{}); err != nil || !result.Cached {
+		t.Error("testdata/test1.go should be cached the second time, but got", result, err)
+	}
+}
+
+func TestVerifyBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosafe-verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.Allow(ChildPackage)
+	c.VerifyBinary = true
+	c.CacheDir = ""
+	defer c.Close()
+	for _, f := range []string{"testdata/test1.go", "testdata/test3.go"} {
+		if err = c.CompileTo(f, dir+"/verified.gosafe"); err != nil {
+			t.Error(f, "should pass VerifyBinary, but got", err)
+		}
+	}
+	c.Gas = 100000
+	if err = c.CompileTo("testdata/test15.go", dir+"/verified.gosafe"); err != nil {
+		t.Error("testdata/test15.go should pass VerifyBinary with Gas, but got", err)
+	}
+	// A binary linking fmt, as if the source check had missed it
+	c.Gas = 0
+	if err = c.CompileTo("testdata/test1.go", dir+"/test1.gosafe"); err != nil {
+		t.Fatal("testdata/test1.go should compile, but got", err)
+	}
+	strict := NewCompiler()
+	defer strict.Close()
+	sources, err := readSources([]string{"testdata/test1.go"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moduleDir, root, err := strict.newModule(context.Background(), []string{"testdata/test1.go"}, sources, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	env, err := strict.buildEnv(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkErr *CheckError
+	if err = strict.verifyBinary(context.Background(), dir+"/test1.gosafe", moduleDir, env); errors.As(err, &checkErr) {
+		found := false
+		for _, violation := range checkErr.ByKind()[DisallowedLinkage] {
+			if violation.ImportPath == "fmt" {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("testdata/test1.go should be reported for linking fmt, but got", checkErr)
+		}
+	} else {
+		t.Error("testdata/test1.go should not pass VerifyBinary without fmt, but got", err)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	c := NewCompiler()
+	defer c.Close()
+	f := "testdata/test18.go"
+	var compileErr *CompileError
+	if _, err := c.Compile(f); errors.As(err, &compileErr) {
+		wanted := []Diagnostic{
+			Diagnostic{File: f, Line: 4, Col: 2, Message: "declared and not used: x"},
+			Diagnostic{File: f, Line: 5, Col: 2, Message: "undefined: undefined"},
+		}
+		if !reflect.DeepEqual(compileErr.Diagnostics, wanted) {
+			t.Error(f, "should give", wanted, "but got", compileErr.Diagnostics)
+		}
+	} else {
+		t.Error(f, "should give a *CompileError, but got", err)
+	}
+	s := "package main\n\nfunc main() {\n\ty := 2\n}\n"
+	if _, err := c.CommandSource("editor.go", []byte(s)); errors.As(err, &compileErr) {
+		if len(compileErr.Diagnostics) != 1 || compileErr.Diagnostics[0].File != "editor.go" || compileErr.Diagnostics[0].Line != 4 {
+			t.Error(s, "should give a diagnostic at editor.go:4, but got", compileErr.Diagnostics)
+		}
+	} else {
+		t.Error(s, "should give a *CompileError, but got", err)
+	}
+}
+
+func TestToolchain(t *testing.T) {
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goVersion, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gosafe-toolchain-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCompiler()
+	c.Allow("fmt")
+	defer c.Close()
+	for _, toolchain := range []string{strings.TrimSpace(string(goroot)), strings.TrimSpace(string(goroot)) + "/bin/go"} {
+		c.Toolchain = toolchain
+		if result, err := c.CompileToWith("testdata/test1.go", dir+"/test1.gosafe", BuildOptions{}); err != nil || result.Toolchain != strings.TrimSpace(string(goVersion)) {
+			t.Error("testdata/test1.go should compile with toolchain", toolchain, "version", string(goVersion), "but got", result, err)
+		}
+	}
+	c.Toolchain = dir + "/missing"
+	if err = c.CompileTo("testdata/test1.go", dir+"/test1.gosafe"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Error("testdata/test1.go should not compile with a missing toolchain, but got", err)
+	}
+	old := dir + "/go"
+	if err = ioutil.WriteFile(old, []byte("#!/bin/sh\necho go1.20.1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.Toolchain = old
+	if err = c.CompileTo("testdata/test1.go", dir+"/test1.gosafe"); err == nil || !strings.Contains(err.Error(), "older than") {
+		t.Error("testdata/test1.go should not compile with go1.20.1, but got", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosafe-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCompiler()
+	c.Allow("fmt")
+	c.VerifyBinary = true
+	c.CacheDir = dir + "/cache"
+	defer c.Close()
+	var stages []Stage
+	ctx := WithProgress(context.Background(), func(stage Stage) {
+		stages = append(stages, stage)
+	})
+	f := "testdata/test1.go"
+	if _, err = c.CompileContext(ctx, f); err != nil {
+		t.Fatal(f, "should compile, but got", err)
+	}
+	if wanted := []Stage{Checking, Building, Verifying}; !reflect.DeepEqual(stages, wanted) {
+		t.Error(f, "should report", wanted, "but got", stages)
+	}
+	stages = nil
+	if _, err = c.CompileContext(ctx, f); err != nil {
+		t.Fatal(f, "should compile, but got", err)
+	}
+	if wanted := []Stage{Checking, Cached}; !reflect.DeepEqual(stages, wanted) {
+		t.Error(f, "should report", wanted, "the second time, but got", stages)
+	}
+	// With an empty build cache building takes long enough to be canceled
+	c.CacheDir = ""
+	c.BuildCache = dir + "/go-build"
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*200, cancel)
+	if _, err = c.CommandContext(ctx, "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"testcontext\") }\n"); !errors.Is(err, context.Canceled) {
+		t.Error("building should be canceled, but got", err)
+	}
+}
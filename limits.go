@@ -0,0 +1,122 @@
+package gosafe
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+)
+
+// Limits are limits on the size and complexity of checked code, to stop code that would make go build use excessive memory or time.
+// They are enforced by Check, before the code is type checked or built. Zero values mean no limit.
+type Limits struct {
+	// MaxSourceBytes is the maximum total size of the source files of a program.
+	MaxSourceBytes int64 `json:"maxSourceBytes,omitempty"`
+	// MaxNodes is the maximum total number of syntax tree nodes of a program.
+	MaxNodes int `json:"maxNodes,omitempty"`
+	// MaxDepth is the maximum nesting depth of the syntax tree of a file.
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// MaxLiteralBytes is the maximum size of a single basic literal, like a string or number.
+	MaxLiteralBytes int `json:"maxLiteralBytes,omitempty"`
+	// MaxCompositeElements is the maximum number of elements of a single composite literal.
+	MaxCompositeElements int `json:"maxCompositeElements,omitempty"`
+	// MaxDecls is the maximum total number of top level declarations of a program, counting each spec of grouped declarations.
+	MaxDecls int `json:"maxDecls,omitempty"`
+}
+
+// merge overrides the limits in this Limits with the ones set in other.
+func (self *Limits) merge(other Limits) {
+	if other.MaxSourceBytes != 0 {
+		self.MaxSourceBytes = other.MaxSourceBytes
+	}
+	if other.MaxNodes != 0 {
+		self.MaxNodes = other.MaxNodes
+	}
+	if other.MaxDepth != 0 {
+		self.MaxDepth = other.MaxDepth
+	}
+	if other.MaxLiteralBytes != 0 {
+		self.MaxLiteralBytes = other.MaxLiteralBytes
+	}
+	if other.MaxCompositeElements != 0 {
+		self.MaxCompositeElements = other.MaxCompositeElements
+	}
+	if other.MaxDecls != 0 {
+		self.MaxDecls = other.MaxDecls
+	}
+}
+
+func limitViolation(pos token.Position, limit string, value, max int64) Violation {
+	return Violation{
+		Pos:     pos,
+		Kind:    LimitExceeded,
+		Message: fmt.Sprintf("%v exceeded: %v > %v", limit, value, max),
+		Rule:    limit,
+	}
+}
+
+// checkSourceSize returns a violation if files, with the contents in sources, are bigger than allowed by the Limits of this gosafe.Compiler.
+func (self *Compiler) checkSourceSize(files []string, sources map[string][]byte) []Violation {
+	if self.Limits.MaxSourceBytes == 0 {
+		return nil
+	}
+	var size int64
+	for _, file := range files {
+		size += int64(len(sources[file]))
+	}
+	if size > self.Limits.MaxSourceBytes {
+		return []Violation{limitViolation(token.Position{Filename: files[0]}, "MaxSourceBytes", size, self.Limits.MaxSourceBytes)}
+	}
+	return nil
+}
+
+// checkLimits returns violations for all Limits of this gosafe.Compiler exceeded by the given parsed files of one program.
+func (self *Compiler) checkLimits(fset *token.FileSet, trees []*ast.File) (violations []Violation) {
+	limits := self.Limits
+	nodes := 0
+	decls := 0
+	for _, tree := range trees {
+		for _, decl := range tree.Decls {
+			if genDecl, ok := decl.(*ast.GenDecl); ok {
+				decls += len(genDecl.Specs)
+			} else {
+				decls++
+			}
+		}
+		depth := 0
+		maxDepth := 0
+		var deepest ast.Node
+		ast.Inspect(tree, func(node ast.Node) bool {
+			if node == nil {
+				depth--
+				return true
+			}
+			depth++
+			nodes++
+			if depth > maxDepth {
+				maxDepth = depth
+				deepest = node
+			}
+			switch node := node.(type) {
+			case *ast.BasicLit:
+				if limits.MaxLiteralBytes != 0 && len(node.Value) > limits.MaxLiteralBytes {
+					violations = append(violations, limitViolation(fset.Position(node.Pos()), "MaxLiteralBytes", int64(len(node.Value)), int64(limits.MaxLiteralBytes)))
+				}
+			case *ast.CompositeLit:
+				if limits.MaxCompositeElements != 0 && len(node.Elts) > limits.MaxCompositeElements {
+					violations = append(violations, limitViolation(fset.Position(node.Pos()), "MaxCompositeElements", int64(len(node.Elts)), int64(limits.MaxCompositeElements)))
+				}
+			}
+			return true
+		})
+		if limits.MaxDepth != 0 && maxDepth > limits.MaxDepth {
+			violations = append(violations, limitViolation(fset.Position(deepest.Pos()), "MaxDepth", int64(maxDepth), int64(limits.MaxDepth)))
+		}
+	}
+	if limits.MaxNodes != 0 && nodes > limits.MaxNodes {
+		violations = append(violations, limitViolation(fset.Position(trees[0].Pos()), "MaxNodes", int64(nodes), int64(limits.MaxNodes)))
+	}
+	if limits.MaxDecls != 0 && decls > limits.MaxDecls {
+		violations = append(violations, limitViolation(fset.Position(trees[0].Pos()), "MaxDecls", int64(decls), int64(limits.MaxDecls)))
+	}
+	return violations
+}
@@ -0,0 +1,187 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChildPackage is the import path of the package child processes use to communicate with their parent.
+const ChildPackage = "github.com/zond/gosafe/child"
+
+// moduleName is the module path of the throwaway modules the checked code is built in.
+const moduleName = "gosafe.program"
+
+var goVersionPattern = regexp.MustCompile(`go(\d+)\.(\d+)`)
+
+// childDir returns the directory containing the source of ChildPackage, if it is available next to the source of this package.
+func childDir() (string, bool) {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return "", false
+	}
+	dir := filepath.Join(filepath.Dir(file), "child")
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// Replace will make imports of the package p use the source in dir when building code with this gosafe.Compiler, like a replace directive in a go.mod file.
+// It doesn't allow importing p, use Allow or Trust for that.
+// New Compilers replace ChildPackage with the child directory next to the source of this package, if available.
+func (self *Compiler) Replace(p, dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.replaced[p] = absDir
+	return nil
+}
+
+// goVersion returns the Go version to put in the go.mod files of the throwaway modules: the GoVersion of this gosafe.Compiler
+// if set, otherwise the language version of the go toolchain.
+func (self *Compiler) goVersion(ctx context.Context) (string, error) {
+	if self.GoVersion != "" {
+		return self.GoVersion, nil
+	}
+	version, err := self.toolchainVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	match := goVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return "", Error(fmt.Sprintf("Unable to parse go version %q", version))
+	}
+	return fmt.Sprint(match[1], ".", match[2]), nil
+}
+
+// copyPackage copies the non test files of the package in src to dst. Unless the package is trusted only its Go files are copied, since
+// go build would use assembly, C sources and other files without them being checked.
+func copyPackage(src, dst string, trusted bool) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == "go.mod" || entry.Name() == "go.sum" || strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+		if !trusted && !strings.HasSuffix(entry.Name(), ".go") {
+			continue
+		}
+		if err = copyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+// newModule creates a throwaway module containing files with the contents in sources, instrumented to spend gas if instrumented is set, with a go.mod requiring
+// all replaced packages and replacing them with copies of their source. The go.mod files use the language version lang, if set.
+// Returns the directory of the main package of the module, and the root directory of the module that should be removed when done.
+func (self *Compiler) newModule(ctx context.Context, files []string, sources map[string][]byte, instrumented bool, lang string) (dir, root string, err error) {
+	goVersion := lang
+	if goVersion == "" {
+		if goVersion, err = self.goVersion(ctx); err != nil {
+			return "", "", err
+		}
+	}
+	if root, err = ioutil.TempDir("", "gosafe"); err != nil {
+		return "", "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(root)
+		}
+	}()
+	dir = filepath.Join(root, "program")
+	if err = os.Mkdir(dir, 0700); err != nil {
+		return "", "", err
+	}
+	if instrumented {
+		if err = self.writeInstrumented(files, sources, dir); err != nil {
+			return "", "", err
+		}
+	} else {
+		for _, file := range files {
+			if err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(file)), sources[file], 0600); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	var paths []string
+	for p, _ := range self.replaced {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var goMod bytes.Buffer
+	fmt.Fprintf(&goMod, "module %v\n\ngo %v\n", moduleName, goVersion)
+	for index, p := range paths {
+		replacement := filepath.Join(root, "replaced", fmt.Sprint(index))
+		if err = os.MkdirAll(replacement, 0700); err != nil {
+			return "", "", err
+		}
+		_, trusted := matchAny(self.trusted, p)
+		if err = copyPackage(self.replaced[p], replacement, trusted); err != nil {
+			return "", "", err
+		}
+		if instrumented && p == ChildPackage {
+			if err = self.writeGas(replacement); err != nil {
+				return "", "", err
+			}
+		}
+		if err = ioutil.WriteFile(filepath.Join(replacement, "go.mod"), []byte(fmt.Sprintf("module %v\n\ngo %v\n", p, goVersion)), 0600); err != nil {
+			return "", "", err
+		}
+		fmt.Fprintf(&goMod, "\nrequire %v v0.0.0\n\nreplace %v => %q\n", p, p, replacement)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "go.mod"), goMod.Bytes(), 0600); err != nil {
+		return "", "", err
+	}
+	return dir, root, nil
+}
+
+// checkReplaced returns DisallowedFile violations for the files go build would use without them being checked, like assembly or C sources,
+// in the replaced packages that aren't trusted and that trees import.
+func (self *Compiler) checkReplaced(trees []*ast.File) (violations []Violation) {
+	buildContext := self.buildContext(self.BuildOptions)
+	seen := make(map[string]bool)
+	for _, tree := range trees {
+		for _, spec := range tree.Imports {
+			p, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || seen[p] {
+				continue
+			}
+			seen[p] = true
+			dir, replaced := self.replaced[p]
+			if _, trusted := matchAny(self.trusted, p); !replaced || trusted {
+				continue
+			}
+			// Whatever could be read is enough, the toolchain reports the rest
+			if pkg, _ := buildContext.ImportDir(dir, 0); pkg != nil {
+				violations = append(violations, fileViolations(dir, unvettedFiles(pkg))...)
+			}
+		}
+	}
+	return violations
+}
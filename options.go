@@ -0,0 +1,87 @@
+package gosafe
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	buildTagPattern = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+	langPattern     = regexp.MustCompile(`^1\.\d+$`)
+	goamd64Pattern  = regexp.MustCompile(`^v[1-4]$`)
+	ldflagsXPattern = regexp.MustCompile(`^-X=main\.[A-Za-z_][A-Za-z0-9_]*=[^\s'"\\]*$`)
+	allowedGCFlags  = map[string]bool{"-N": true, "-l": true, "-C": true, "-dwarf=false": true}
+	allowedLDFlags  = map[string]bool{"-s": true, "-w": true}
+)
+
+// BuildOptions are the options of go build when building checked code.
+// Only options that can't make the toolchain run other programs, read other files or change what is built are available, and they are validated
+// before every build. The race detector is not available, since it requires cgo and checked code is always built with CGO_ENABLED=0.
+type BuildOptions struct {
+	// Trimpath removes all file system paths from the built binary, like `go build -trimpath`.
+	Trimpath bool `json:"trimpath,omitempty"`
+	// Tags are the build tags to build with, like `go build -tags`. Only letters, digits, underscores and dots are allowed.
+	Tags []string `json:"tags,omitempty"`
+	// GCFlags are the compiler flags used for the checked code, like `go build -gcflags`. Only -N, -l, -C and -dwarf=false are allowed,
+	// and not -B which would turn off bounds checking.
+	GCFlags []string `json:"gcflags,omitempty"`
+	// LDFlags are the linker flags, like `go build -ldflags`. Only -s, -w and -X=main.name=value are allowed, so that
+	// only variables of the checked code can be set.
+	LDFlags []string `json:"ldflags,omitempty"`
+	// Lang is the language version of the checked code, like "1.21", as used by the -lang flag of the compiler. Defaults to GoVersion.
+	Lang string `json:"lang,omitempty"`
+	// GOAMD64 is the amd64 microarchitecture level to build for, "v1" to "v4". Only affects amd64 builds.
+	GOAMD64 string `json:"goamd64,omitempty"`
+}
+
+// validate returns an error if this BuildOptions contains an option that is not allowed.
+func (self *BuildOptions) validate() error {
+	for _, tag := range self.Tags {
+		if !buildTagPattern.MatchString(tag) {
+			return Error(fmt.Sprintf("Build tag %q not allowed", tag))
+		}
+	}
+	for _, flag := range self.GCFlags {
+		if !allowedGCFlags[flag] {
+			return Error(fmt.Sprintf("Compiler flag %q not allowed", flag))
+		}
+	}
+	for _, flag := range self.LDFlags {
+		if !allowedLDFlags[flag] && !ldflagsXPattern.MatchString(flag) {
+			return Error(fmt.Sprintf("Linker flag %q not allowed", flag))
+		}
+	}
+	if self.Lang != "" && !langPattern.MatchString(self.Lang) {
+		return Error(fmt.Sprintf("Language version %q not allowed", self.Lang))
+	}
+	if self.GOAMD64 != "" && !goamd64Pattern.MatchString(self.GOAMD64) {
+		return Error(fmt.Sprintf("GOAMD64 %q not allowed", self.GOAMD64))
+	}
+	return nil
+}
+
+// args returns the go build flags of this BuildOptions.
+func (self *BuildOptions) args() (rval []string) {
+	if self.Trimpath {
+		rval = append(rval, "-trimpath")
+	}
+	if len(self.Tags) > 0 {
+		rval = append(rval, fmt.Sprint("-tags=", strings.Join(self.Tags, ",")))
+	}
+	if len(self.GCFlags) > 0 {
+		rval = append(rval, fmt.Sprint("-gcflags=", strings.Join(self.GCFlags, " ")))
+	}
+	if len(self.LDFlags) > 0 {
+		rval = append(rval, fmt.Sprint("-ldflags=", strings.Join(self.LDFlags, " ")))
+	}
+	return rval
+}
+
+// env returns the go build environment variables of this BuildOptions.
+func (self *BuildOptions) env() (rval []string) {
+	if self.GOAMD64 != "" {
+		rval = append(rval, fmt.Sprint("GOAMD64=", self.GOAMD64))
+	}
+	return rval
+}
@@ -0,0 +1,79 @@
+package gosafe
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matchPattern returns whether the import path p matches pattern, where "..." matches any string, and "x/..." matches x as well,
+// like package patterns for the go command.
+func matchPattern(pattern, p string) bool {
+	if !strings.Contains(pattern, "...") {
+		return pattern == p
+	}
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(expr, `/.*`) {
+		expr = fmt.Sprint(strings.TrimSuffix(expr, `/.*`), `(/.*)?`)
+	}
+	matched, _ := regexp.MatchString(fmt.Sprint("^", expr, "$"), p)
+	return matched
+}
+
+// matchAny returns the pattern among the quoted patterns in patterns that matches p, preferring an exact match and then the longest pattern.
+// The runtime package is only matched exactly, since allowing it requires a conscious effort.
+func matchAny(patterns map[string]bool, p string) (string, bool) {
+	if patterns[strconv.Quote(p)] {
+		return p, true
+	}
+	if p == "runtime" {
+		return "", false
+	}
+	var matches []string
+	for quoted, _ := range patterns {
+		if pattern, err := strconv.Unquote(quoted); err == nil && matchPattern(pattern, p) {
+			matches = append(matches, pattern)
+		}
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if len(matches[i]) != len(matches[j]) {
+			return len(matches[i]) > len(matches[j])
+		}
+		return matches[i] < matches[j]
+	})
+	return matches[0], true
+}
+
+// deniedBy returns the Deny pattern of this gosafe.Compiler that denies p, if any.
+func (self *Compiler) deniedBy(p string) (string, bool) {
+	return matchAny(self.denied, p)
+}
+
+// Explain returns whether code checked by this gosafe.Compiler may import p, and a description of the rule that decided it.
+// Deny patterns take precedence over Allow and Trust patterns and symbols allowed with AllowSymbol.
+func (self *Compiler) Explain(p string) (allowed bool, rule string) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.explain(p)
+}
+
+func (self *Compiler) explain(p string) (allowed bool, rule string) {
+	if pattern, found := self.deniedBy(p); found {
+		return false, fmt.Sprintf("deny %q", pattern)
+	}
+	if pattern, found := matchAny(self.allowed, p); found {
+		return true, fmt.Sprintf("allow %q", pattern)
+	}
+	if pattern, found := matchAny(self.trusted, p); found {
+		return true, fmt.Sprintf("trust %q", pattern)
+	}
+	if self.allowedSymbols[p] != nil {
+		return true, fmt.Sprintf("allowSymbol %q", p)
+	}
+	return false, "no allow rule"
+}
@@ -0,0 +1,307 @@
+package gosafe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Policy is a declarative description of what a Compiler allows.
+// Rules are Go code, and not part of the Policy.
+type Policy struct {
+	// Allow are the packages to Allow.
+	Allow []string `json:"allow,omitempty"`
+	// Presets are the names of the Presets to AllowPreset, like "pure-compute/v1".
+	Presets []string `json:"presets,omitempty"`
+	// Deny are the packages to Deny.
+	Deny []string `json:"deny,omitempty"`
+	// Trust are the packages to Trust.
+	Trust []string `json:"trust,omitempty"`
+	// AllowRuntime makes the Compiler AllowRuntime.
+	AllowRuntime bool `json:"allowRuntime,omitempty"`
+	// AllowSymbols are the symbols to AllowSymbol, per package.
+	AllowSymbols map[string][]string `json:"allowSymbols,omitempty"`
+	// DenySymbols are the symbols to DenySymbol, per package.
+	DenySymbols map[string][]string `json:"denySymbols,omitempty"`
+	// AllowDirectives are the directives to AllowDirective.
+	AllowDirectives []string `json:"allowDirectives,omitempty"`
+	// Replace are the directories to Replace packages with, per package.
+	Replace map[string]string `json:"replace,omitempty"`
+	// TypeCheck sets Compiler.TypeCheck.
+	TypeCheck bool `json:"typeCheck,omitempty"`
+	// VerifyDependencies sets Compiler.VerifyDependencies.
+	VerifyDependencies bool `json:"verifyDependencies,omitempty"`
+	// VerifyBinary sets Compiler.VerifyBinary.
+	VerifyBinary bool `json:"verifyBinary,omitempty"`
+	// GoVersion sets Compiler.GoVersion.
+	GoVersion string `json:"goVersion,omitempty"`
+	// Limits sets the limits of Compiler.Limits that are not zero.
+	Limits Limits `json:"limits"`
+}
+
+// Profile is a named Policy in a PolicyConfig, that can inherit other profiles.
+// Profiles can only add to what they inherit, except for GoVersion and Limits which they can override.
+type Profile struct {
+	// Inherits are the names of the profiles this Profile inherits.
+	Inherits []string `json:"inherits,omitempty"`
+	Policy
+}
+
+// PolicyConfig is the format of policy files, like
+//
+//	{
+//	  "use": "tenant",
+//	  "profiles": {
+//	    "base": {"allow": ["fmt", "math"], "deny": ["unsafe"]},
+//	    "tenant": {"inherits": ["base"], "allow": ["strings"], "typeCheck": true}
+//	  }
+//	}
+//
+// If no profile is used, the top level Profile of the PolicyConfig is, so a plain Policy is a valid PolicyConfig as well.
+type PolicyConfig struct {
+	// Use is the name of the profile to use.
+	Use string `json:"use,omitempty"`
+	// Profiles are the named profiles of the PolicyConfig.
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	Profile
+}
+
+// Effective returns the Policy of the used Profile of this PolicyConfig, including everything it inherits.
+func (self *PolicyConfig) Effective() (rval Policy, err error) {
+	profile := self.Profile
+	visiting := make(map[string]bool)
+	if self.Use != "" {
+		var ok bool
+		if profile, ok = self.Profiles[self.Use]; !ok {
+			return rval, Error(fmt.Sprintf("No such profile: %v", self.Use))
+		}
+		visiting[self.Use] = true
+	}
+	err = self.resolve(&rval, profile, visiting)
+	return rval, err
+}
+
+// resolve adds the policy of profile, and everything it inherits, to policy.
+// visiting contains the names of the profiles currently being resolved, to detect inheritance cycles.
+func (self *PolicyConfig) resolve(policy *Policy, profile Profile, visiting map[string]bool) error {
+	for _, name := range profile.Inherits {
+		if visiting[name] {
+			return Error(fmt.Sprintf("Profile %v inherits itself", name))
+		}
+		inherited, ok := self.Profiles[name]
+		if !ok {
+			return Error(fmt.Sprintf("No such profile: %v", name))
+		}
+		visiting[name] = true
+		if err := self.resolve(policy, inherited, visiting); err != nil {
+			return err
+		}
+		delete(visiting, name)
+	}
+	policy.merge(profile.Policy)
+	return nil
+}
+
+// merge adds everything in other to this Policy, and overrides its GoVersion and Limits with the ones other has.
+func (self *Policy) merge(other Policy) {
+	self.Allow = append(self.Allow, other.Allow...)
+	self.Presets = append(self.Presets, other.Presets...)
+	self.Deny = append(self.Deny, other.Deny...)
+	self.Trust = append(self.Trust, other.Trust...)
+	self.AllowRuntime = self.AllowRuntime || other.AllowRuntime
+	for p, names := range other.AllowSymbols {
+		if self.AllowSymbols == nil {
+			self.AllowSymbols = make(map[string][]string)
+		}
+		self.AllowSymbols[p] = append(self.AllowSymbols[p], names...)
+	}
+	for p, names := range other.DenySymbols {
+		if self.DenySymbols == nil {
+			self.DenySymbols = make(map[string][]string)
+		}
+		self.DenySymbols[p] = append(self.DenySymbols[p], names...)
+	}
+	self.AllowDirectives = append(self.AllowDirectives, other.AllowDirectives...)
+	for p, dir := range other.Replace {
+		if self.Replace == nil {
+			self.Replace = make(map[string]string)
+		}
+		self.Replace[p] = dir
+	}
+	self.TypeCheck = self.TypeCheck || other.TypeCheck
+	self.VerifyDependencies = self.VerifyDependencies || other.VerifyDependencies
+	self.VerifyBinary = self.VerifyBinary || other.VerifyBinary
+	if other.GoVersion != "" {
+		self.GoVersion = other.GoVersion
+	}
+	self.Limits.merge(other.Limits)
+}
+
+// NewCompilerFromConfig returns a new Compiler with the policy of the PolicyConfig read from r.
+func NewCompilerFromConfig(r io.Reader) (*Compiler, error) {
+	rval := NewCompiler()
+	if err := rval.LoadPolicy(r); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
+// LoadPolicy will add the effective Policy of the PolicyConfig read from r to this gosafe.Compiler.
+// Unknown fields in the PolicyConfig are errors, to catch misspelled policies.
+func (self *Compiler) LoadPolicy(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var config PolicyConfig
+	if err := decoder.Decode(&config); err != nil {
+		return err
+	}
+	policy, err := config.Effective()
+	if err != nil {
+		return err
+	}
+	return self.ApplyPolicy(policy)
+}
+
+// ApplyPolicy will add policy to this gosafe.Compiler.
+func (self *Compiler) ApplyPolicy(policy Policy) error {
+	for _, p := range policy.Allow {
+		if p == "runtime" {
+			return Error("Allowing \"runtime\" requires allowRuntime. See https://github.com/zond/gosafe/issues/1")
+		}
+	}
+	var presets []Preset
+	for _, name := range policy.Presets {
+		preset, err := LookupPreset(name)
+		if err != nil {
+			return err
+		}
+		presets = append(presets, preset)
+	}
+	replaced := make(map[string]string)
+	for p, dir := range policy.Replace {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		replaced[p] = absDir
+	}
+	// Everything at once, so that concurrent checks and compiles see either none or all of the policy
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for p, dir := range replaced {
+		self.replaced[p] = dir
+	}
+	for _, p := range policy.Allow {
+		self.allow(p)
+	}
+	for _, preset := range presets {
+		self.allowPreset(preset)
+	}
+	for _, p := range policy.Deny {
+		self.deny(p)
+	}
+	for _, p := range policy.Trust {
+		self.trust(p)
+	}
+	if policy.AllowRuntime {
+		self.allowRuntime()
+	}
+	for p, names := range policy.AllowSymbols {
+		for _, name := range names {
+			self.allowSymbol(p, name)
+		}
+	}
+	for p, names := range policy.DenySymbols {
+		for _, name := range names {
+			self.denySymbol(p, name)
+		}
+	}
+	for _, directive := range policy.AllowDirectives {
+		self.allowDirective(directive)
+	}
+	self.TypeCheck = self.TypeCheck || policy.TypeCheck
+	self.VerifyDependencies = self.VerifyDependencies || policy.VerifyDependencies
+	self.VerifyBinary = self.VerifyBinary || policy.VerifyBinary
+	if policy.GoVersion != "" {
+		self.GoVersion = policy.GoVersion
+	}
+	self.Limits.merge(policy.Limits)
+	return nil
+}
+
+// unquotedKeys returns the sorted, unquoted keys of m.
+func unquotedKeys(m map[string]bool) (rval []string) {
+	for quoted, _ := range m {
+		if p, err := strconv.Unquote(quoted); err == nil {
+			rval = append(rval, p)
+		}
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+func sortedKeys(m map[string]bool) (rval []string) {
+	for key, _ := range m {
+		rval = append(rval, key)
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+// Policy returns the effective Policy of this gosafe.Compiler.
+// Packages allowed by Presets are included in Allow.
+func (self *Compiler) Policy() Policy {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.policy()
+}
+
+func (self *Compiler) policy() (rval Policy) {
+	for _, p := range unquotedKeys(self.allowed) {
+		if p == "runtime" {
+			rval.AllowRuntime = true
+		} else {
+			rval.Allow = append(rval.Allow, p)
+		}
+	}
+	rval.Deny = unquotedKeys(self.denied)
+	rval.Trust = unquotedKeys(self.trusted)
+	for p, names := range self.allowedSymbols {
+		if rval.AllowSymbols == nil {
+			rval.AllowSymbols = make(map[string][]string)
+		}
+		rval.AllowSymbols[p] = sortedKeys(names)
+	}
+	for p, names := range self.deniedSymbols {
+		if rval.DenySymbols == nil {
+			rval.DenySymbols = make(map[string][]string)
+		}
+		rval.DenySymbols[p] = sortedKeys(names)
+	}
+	rval.AllowDirectives = sortedKeys(self.directives)
+	for p, dir := range self.replaced {
+		if rval.Replace == nil {
+			rval.Replace = make(map[string]string)
+		}
+		rval.Replace[p] = dir
+	}
+	rval.TypeCheck = self.TypeCheck
+	rval.VerifyDependencies = self.VerifyDependencies
+	rval.VerifyBinary = self.VerifyBinary
+	rval.GoVersion = self.GoVersion
+	rval.Limits = self.Limits
+	return rval
+}
+
+// DumpPolicy will write the effective Policy of this gosafe.Compiler to w, in a format LoadPolicy can read.
+func (self *Compiler) DumpPolicy(w io.Writer) error {
+	b, err := json.MarshalIndent(self.Policy(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,121 @@
+package gosafe
+
+import (
+	"fmt"
+)
+
+// Preset is a vetted set of standard library packages to allow with Compiler.AllowPreset.
+// The packages of a Preset never change, new packages are added in new versions of the Preset, so that upgrading gosafe doesn't
+// silently widen what a Compiler allows.
+// All packages in all Presets are free of filesystem, network, process and unsafe access.
+type Preset struct {
+	// Name is the versioned name of the Preset, like "pure-compute/v1".
+	Name string
+	// Packages are the packages allowed by the Preset.
+	Packages []string
+	// DenySymbols are the symbols, per package, denied by the Preset because they would give unsafe access through the allowed packages.
+	DenySymbols map[string][]string
+}
+
+// PresetPureComputeV1 allows packages for pure computation: data structures, math, sorting, strings, unicode and regular expressions.
+var PresetPureComputeV1 = Preset{
+	Name: "pure-compute/v1",
+	Packages: []string{
+		"bytes",
+		"cmp",
+		"container/heap",
+		"container/list",
+		"container/ring",
+		"errors",
+		"hash",
+		"hash/adler32",
+		"hash/crc32",
+		"hash/crc64",
+		"hash/fnv",
+		"iter",
+		"maps",
+		"math",
+		"math/big",
+		"math/bits",
+		"math/cmplx",
+		"math/rand",
+		"math/rand/v2",
+		"regexp",
+		"regexp/syntax",
+		"slices",
+		"sort",
+		"strconv",
+		"strings",
+		"unicode",
+		"unicode/utf16",
+		"unicode/utf8",
+	},
+}
+
+// PresetEncodingV1 allows packages for encoding and decoding data formats.
+// Since encoding/json and encoding/xml expose reflect.Type, it denies the reflect symbols that give access to unsafe.Pointers.
+var PresetEncodingV1 = Preset{
+	Name: "encoding/v1",
+	Packages: []string{
+		"encoding",
+		"encoding/ascii85",
+		"encoding/base32",
+		"encoding/base64",
+		"encoding/binary",
+		"encoding/csv",
+		"encoding/hex",
+		"encoding/json",
+		"encoding/pem",
+		"encoding/xml",
+	},
+	DenySymbols: map[string][]string{
+		"reflect": []string{
+			"NewAt",
+			"SliceAt",
+			"Value.SetPointer",
+			"Value.UnsafePointer",
+		},
+	},
+}
+
+// PresetPureCompute is the latest version of the pure compute Preset, currently PresetPureComputeV1.
+// Use a versioned Preset to make sure upgrading gosafe never widens what a Compiler allows.
+var PresetPureCompute = PresetPureComputeV1
+
+// PresetEncoding is the latest version of the encoding Preset, currently PresetEncodingV1.
+// Use a versioned Preset to make sure upgrading gosafe never widens what a Compiler allows.
+var PresetEncoding = PresetEncodingV1
+
+// Presets are all versions of all Presets.
+var Presets = []Preset{
+	PresetPureComputeV1,
+	PresetEncodingV1,
+}
+
+// LookupPreset returns the Preset with the given versioned name, like "encoding/v1".
+func LookupPreset(name string) (Preset, error) {
+	for _, preset := range Presets {
+		if preset.Name == name {
+			return preset, nil
+		}
+	}
+	return Preset{}, Error(fmt.Sprintf("No such preset: %v", name))
+}
+
+// AllowPreset will Allow all packages, and DenySymbol all denied symbols, of preset for this gosafe.Compiler.
+func (self *Compiler) AllowPreset(preset Preset) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allowPreset(preset)
+}
+
+func (self *Compiler) allowPreset(preset Preset) {
+	for _, p := range preset.Packages {
+		self.allow(p)
+	}
+	for p, names := range preset.DenySymbols {
+		for _, name := range names {
+			self.denySymbol(p, name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package gosafe
+
+import (
+	"context"
+)
+
+// Stage is a stage of checking and compiling code, reported to the ProgressFunc of the context given to the Context methods of a Compiler.
+type Stage string
+
+const (
+	// Checking is reported when the code is checked against the policy of the Compiler.
+	Checking Stage = "checking"
+	// Building is reported when the go toolchain builds the code, or when waiting for a concurrent build of the same code.
+	Building Stage = "building"
+	// Verifying is reported when a built binary is verified because of Compiler.VerifyBinary.
+	Verifying Stage = "verifying"
+	// Cached is reported when a binary is taken from a cache instead of being built.
+	Cached Stage = "cached"
+)
+
+// ProgressFunc is called with every Stage reached while checking and compiling code.
+type ProgressFunc func(stage Stage)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx that makes the Context methods of a Compiler report their progress to fn.
+// fn is called from the goroutine calling the method.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progress reports stage to the ProgressFunc of ctx, if any.
+func progress(ctx context.Context, stage Stage) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		fn(stage)
+	}
+}
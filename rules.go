@@ -0,0 +1,42 @@
+package gosafe
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Rule is a custom policy check run by Compiler.Check on every checked file, after the file has been type checked.
+// Violations returned without a Kind get the Kind RuleViolation.
+type Rule interface {
+	Check(fset *token.FileSet, file *ast.File, info *types.Info) []Violation
+}
+
+// RuleFunc makes a function a Rule.
+type RuleFunc func(fset *token.FileSet, file *ast.File, info *types.Info) []Violation
+
+func (self RuleFunc) Check(fset *token.FileSet, file *ast.File, info *types.Info) []Violation {
+	return self(fset, file, info)
+}
+
+// AddRule will make Check run rule on every file checked by this gosafe.Compiler.
+func (self *Compiler) AddRule(rule Rule) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.rules = append(self.rules, rule)
+}
+
+// checkRules returns the violations found by all rules of this gosafe.Compiler in the given files.
+func (self *Compiler) checkRules(fset *token.FileSet, files []*ast.File, info *types.Info) (violations []Violation) {
+	for _, rule := range self.rules {
+		for _, file := range files {
+			for _, violation := range rule.Check(fset, file, info) {
+				if violation.Kind == "" {
+					violation.Kind = RuleViolation
+				}
+				violations = append(violations, violation)
+			}
+		}
+	}
+	return violations
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package gosafe
+
+import (
+	"os/exec"
+)
+
+// sandbox returns an error if any of the BuildMemory, BuildCPU or BuildNamespaces of this gosafe.Compiler is set, since they
+// are only supported on unix systems.
+func (self *Compiler) sandbox(cmd *exec.Cmd) error {
+	if self.BuildMemory > 0 || self.BuildCPU > 0 || self.BuildNamespaces {
+		return Error("BuildMemory, BuildCPU and BuildNamespaces are only supported on unix systems")
+	}
+	return nil
+}
+
+func limitHit(err error, stderr string) bool {
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build unix && !linux
+
+package gosafe
+
+import (
+	"syscall"
+)
+
+func namespaces(attr *syscall.SysProcAttr) error {
+	return Error("BuildNamespaces is only supported on Linux")
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package gosafe
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// sandbox makes cmd run in its own process group, killed as a whole when cmd is canceled, with the BuildMemory and BuildCPU
+// of this gosafe.Compiler as rlimits, and in new namespaces if BuildNamespaces is set.
+func (self *Compiler) sandbox(cmd *exec.Cmd) error {
+	var limits []string
+	if self.BuildMemory > 0 {
+		limits = append(limits, fmt.Sprint("ulimit -v ", (self.BuildMemory+1023)/1024))
+	}
+	if self.BuildCPU > 0 {
+		limits = append(limits, fmt.Sprint("ulimit -t ", int64((self.BuildCPU+999999999)/1000000000)))
+	}
+	if len(limits) > 0 {
+		// The rlimits are inherited by the compiler and linker processes started by the toolchain
+		script := strings.Join(append(limits, `exec "$0" "$@"`), " && ")
+		cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if self.BuildNamespaces {
+		return namespaces(cmd.SysProcAttr)
+	}
+	return nil
+}
+
+// limitHit returns whether the toolchain failing with err and stderr was caused by the rlimits set by sandbox.
+func limitHit(err error, stderr string) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// The Go runtime crashes with a segmentation fault when it can't even reserve its initial memory
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			switch status.Signal() {
+			case syscall.SIGXCPU, syscall.SIGKILL, syscall.SIGSEGV:
+				return true
+			}
+		}
+	}
+	for _, symptom := range []string{"CPU time limit exceeded", "out of memory", "cannot allocate memory"} {
+		if strings.Contains(stderr, symptom) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package gosafe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sourceFile is the name of source files checked or built without a file of their own.
+const sourceFile = "main.go"
+
+// CheckSource will check src, the content of a file called name, without writing it to disk.
+// Violations are reported under name.
+func (self *Compiler) CheckSource(name string, src []byte) error {
+	compiler := self.snapshot()
+	_, err := compiler.checkSource(context.Background(), name, src)
+	return err
+}
+
+// CheckSourceWarnings will return an error like CheckSource does, and otherwise the violations with Warning severity found in src.
+func (self *Compiler) CheckSourceWarnings(name string, src []byte) ([]Violation, error) {
+	compiler := self.snapshot()
+	return compiler.checkSource(context.Background(), name, src)
+}
+
+func (self *Compiler) checkSource(ctx context.Context, name string, src []byte) ([]Violation, error) {
+	warnings, err := self.checkCached(ctx, []string{name}, map[string][]byte{name: src})
+	if err != nil {
+		return nil, err
+	}
+	if self.VerifyDependencies {
+		if err = self.verifyDeps(ctx, []string{sourceFile}, map[string][]byte{sourceFile: src}); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// CommandSource will return a gosafe.Cmd encapsulating src, the content of a file called name.
+// src is checked in memory like CheckSource does, and only written to the private work directory of this gosafe.Compiler to be built.
+func (self *Compiler) CommandSource(name string, src []byte) (cmd *Cmd, err error) {
+	return self.CommandSourceContext(context.Background(), name, src)
+}
+
+// CommandSourceContext will return a gosafe.Cmd encapsulating src, the content of a file called name, like CommandSource does, and stop
+// checking and compiling it when ctx is done.
+func (self *Compiler) CommandSourceContext(ctx context.Context, name string, src []byte) (cmd *Cmd, err error) {
+	compiler := self.snapshot()
+	warnings, err := compiler.checkSource(ctx, name, src)
+	if err != nil {
+		return nil, err
+	}
+	file, err := compiler.materialize(src)
+	if err != nil {
+		return nil, err
+	}
+	// Only the binary is needed once it is built
+	defer os.RemoveAll(filepath.Dir(file))
+	output := filepath.Join(filepath.Dir(filepath.Dir(file)), fmt.Sprintf("%s.gosafe", compiler.shorten(string(src))))
+	if _, err = compiler.compileTo(ctx, []string{file}, map[string][]byte{file: src}, output, compiler.BuildOptions, func(map[string][]byte) ([]Violation, error) {
+		// Already checked
+		return warnings, nil
+	}); err != nil {
+		var compileErr *CompileError
+		if errors.As(err, &compileErr) {
+			// Report errors in the materialized file under the name it was given
+			return nil, compileErr.rename(func(compiled string) string {
+				if compiled == file {
+					return name
+				}
+				return compiled
+			})
+		}
+		return nil, err
+	}
+	return newCmd(output), nil
+}
+
+// materialize writes src to a new directory in the private work directory of this gosafe.Compiler, and returns the path of the written file.
+// The caller removes the directory when done with it.
+func (self *Compiler) materialize(src []byte) (string, error) {
+	workDir, err := self.work()
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(workDir, "source")
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, sourceFile)
+	if err = ioutil.WriteFile(file, src, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return file, nil
+}
+
+// work returns the private work directory of this gosafe.Compiler, creating it if necessary.
+func (self *Compiler) work() (string, error) {
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	if self.workDir == "" {
+		dir, err := ioutil.TempDir("", "gosafe-work")
+		if err != nil {
+			return "", err
+		}
+		self.workDir = dir
+	}
+	return self.workDir, nil
+}
+
+// Close will remove the private work directory of this gosafe.Compiler, along with the binaries of the Cmds returned by CommandSource and Command.
+func (self *Compiler) Close() error {
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	if self.workDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(self.workDir)
+	self.workDir = ""
+	return err
+}
@@ -0,0 +1,490 @@
+package gosafe
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"strconv"
+)
+
+// symbolName returns the package path and name of obj, with methods named like Type.Method, or false if obj isn't a package level identifier or method.
+func symbolName(obj types.Object) (pkg, name string, ok bool) {
+	if obj.Pkg() == nil {
+		return "", "", false
+	}
+	if function, isFunc := obj.(*types.Func); isFunc {
+		if recv := function.Type().(*types.Signature).Recv(); recv != nil {
+			recvType := types.Unalias(recv.Type())
+			if pointer, isPointer := recvType.(*types.Pointer); isPointer {
+				recvType = types.Unalias(pointer.Elem())
+			}
+			if named, isNamed := recvType.(*types.Named); isNamed {
+				return obj.Pkg().Path(), fmt.Sprint(named.Obj().Name(), ".", obj.Name()), true
+			}
+			return "", "", false
+		}
+	}
+	if obj.Parent() != obj.Pkg().Scope() {
+		return "", "", false
+	}
+	return obj.Pkg().Path(), obj.Name(), true
+}
+
+// matchSymbol returns whether name matches any of the patterns in patterns.
+// Methods also match the patterns of their types.
+func matchSymbol(patterns map[string]bool, name string) bool {
+	for pattern, _ := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(fmt.Sprint(pattern, ".*"), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// packageAllowed returns whether all symbols of p are allowed, not just the ones allowed with AllowSymbol.
+func (self *Compiler) packageAllowed(p string) bool {
+	_, allowed := matchAny(self.allowed, p)
+	_, trusted := matchAny(self.trusted, p)
+	return allowed || trusted
+}
+
+// gasSymbols are the symbols of ChildPackage denied to code checked by a gosafe.Compiler with Gas, since they spend gas or handle Requests
+// with a full tank of it.
+var gasSymbols = map[string]bool{
+	"Step":          true,
+	"Server.Handle": true,
+}
+
+// hasSymbolRules returns whether any symbols used by files may be restricted: if symbols are allowed or denied, or if files import ChildPackage
+// while this gosafe.Compiler has Gas.
+func (self *Compiler) hasSymbolRules(files []*ast.File) bool {
+	if len(self.allowedSymbols) > 0 || len(self.deniedSymbols) > 0 {
+		return true
+	}
+	if self.Gas > 0 {
+		for _, file := range files {
+			for _, spec := range file.Imports {
+				if importPath, _ := strconv.Unquote(spec.Path.Value); importPath == ChildPackage {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// symbolProblem returns how the symbol name of the package pkg is not allowed by this gosafe.Compiler, or false if it is allowed.
+func (self *Compiler) symbolProblem(pkg, name string) (string, bool) {
+	if denied, found := self.deniedSymbols[pkg]; found && matchSymbol(denied, name) {
+		return "denied", true
+	} else if self.Gas > 0 && pkg == ChildPackage && matchSymbol(gasSymbols, name) {
+		return "denied", true
+	} else if allowed, found := self.allowedSymbols[pkg]; found && !self.packageAllowed(pkg) && !matchSymbol(allowed, name) {
+		return "disallowed", true
+	}
+	return "", false
+}
+
+// checkSymbols returns violations for all symbols used in the type checked code described by info that are not allowed by this gosafe.Compiler,
+// and for all conversions, type assertions and instantiations that make such methods callable through interfaces.
+func (self *Compiler) checkSymbols(fset *token.FileSet, files []*ast.File, pkg *types.Package, info *types.Info) (violations []Violation) {
+	for ident, obj := range info.Uses {
+		p, name, ok := symbolName(obj)
+		if !ok {
+			continue
+		}
+		if problem, found := self.symbolProblem(p, name); found {
+			violations = append(violations, Violation{
+				Pos:        fset.Position(ident.Pos()),
+				Kind:       DisallowedSymbol,
+				ImportPath: p,
+				Message:    fmt.Sprintf("Use of %v symbol %v.%v", problem, p, name),
+			})
+		}
+	}
+	if !self.hasSymbolRules(files) {
+		return violations
+	}
+	checker := &conversionChecker{
+		compiler:   self,
+		fset:       fset,
+		info:       info,
+		candidates: self.symbolCandidates(pkg),
+	}
+	for _, file := range files {
+		ast.Walk(checker, file)
+	}
+	for ident, instance := range info.Instances {
+		var params *types.TypeParamList
+		obj := info.Uses[ident]
+		if obj == nil {
+			continue
+		}
+		switch typ := obj.Type().(type) {
+		case *types.Signature:
+			params = typ.TypeParams()
+		case *types.Named:
+			params = typ.TypeParams()
+		}
+		for index := 0; params != nil && index < params.Len() && index < instance.TypeArgs.Len(); index++ {
+			checker.convert(ident, instance.TypeArgs.At(index), params.At(index).Constraint())
+		}
+	}
+	return append(violations, checker.violations...)
+}
+
+// symbolRestricted returns whether this gosafe.Compiler restricts which symbols of p may be used.
+func (self *Compiler) symbolRestricted(p string) bool {
+	_, denied := self.deniedSymbols[p]
+	_, allowed := self.allowedSymbols[p]
+	return denied || (allowed && !self.packageAllowed(p)) || (self.Gas > 0 && p == ChildPackage)
+}
+
+// symbolCandidates returns the non generic types, and pointers to them, declared in packages with symbol restrictions that the code in pkg can
+// get values of without naming them: the types reachable from the symbols it may use in the packages it imports.
+func (self *Compiler) symbolCandidates(pkg *types.Package) []types.Type {
+	if pkg == nil {
+		return nil
+	}
+	reach := &reachability{compiler: self, seen: make(map[types.Type]bool)}
+	for _, imported := range pkg.Imports() {
+		for _, name := range imported.Scope().Names() {
+			obj := imported.Scope().Lookup(name)
+			if !obj.Exported() {
+				continue
+			}
+			if _, found := self.symbolProblem(imported.Path(), name); found {
+				continue
+			}
+			reach.visit(obj.Type())
+		}
+	}
+	return reach.candidates
+}
+
+// reachability collects the types with symbol restrictions reachable from the types it visits through their exported fields and the
+// signatures of their functions and allowed methods.
+type reachability struct {
+	compiler   *Compiler
+	seen       map[types.Type]bool
+	candidates []types.Type
+}
+
+func (self *reachability) visit(typ types.Type) {
+	if typ == nil || self.seen[typ] {
+		return
+	}
+	self.seen[typ] = true
+	switch typ := typ.(type) {
+	case *types.Alias:
+		self.visit(types.Unalias(typ))
+	case *types.Named:
+		obj := typ.Obj()
+		restricted := obj.Pkg() != nil && self.compiler.symbolRestricted(obj.Pkg().Path())
+		if restricted && !types.IsInterface(typ) && typ.TypeParams().Len() == 0 {
+			self.candidates = append(self.candidates, typ, types.NewPointer(typ))
+		}
+		for index := 0; index < typ.NumMethods(); index++ {
+			method := typ.Method(index)
+			if !method.Exported() {
+				continue
+			}
+			if restricted {
+				if _, found := self.compiler.symbolProblem(obj.Pkg().Path(), fmt.Sprint(obj.Name(), ".", method.Name())); found {
+					continue
+				}
+			}
+			self.visit(method.Type())
+		}
+		if args := typ.TypeArgs(); args != nil {
+			for index := 0; index < args.Len(); index++ {
+				self.visit(args.At(index))
+			}
+		}
+		self.visit(typ.Underlying())
+	case *types.Pointer:
+		self.visit(typ.Elem())
+	case *types.Slice:
+		self.visit(typ.Elem())
+	case *types.Array:
+		self.visit(typ.Elem())
+	case *types.Chan:
+		self.visit(typ.Elem())
+	case *types.Map:
+		self.visit(typ.Key())
+		self.visit(typ.Elem())
+	case *types.Signature:
+		self.visit(typ.Params())
+		self.visit(typ.Results())
+	case *types.Tuple:
+		for index := 0; index < typ.Len(); index++ {
+			self.visit(typ.At(index).Type())
+		}
+	case *types.Struct:
+		for index := 0; index < typ.NumFields(); index++ {
+			if field := typ.Field(index); field.Exported() || field.Embedded() {
+				self.visit(field.Type())
+			}
+		}
+	case *types.Interface:
+		for index := 0; index < typ.NumMethods(); index++ {
+			self.visit(typ.Method(index).Type())
+		}
+	}
+}
+
+// conversionChecker is an ast.Visitor finding values converted to interfaces, and interfaces asserted to other interfaces, that make methods
+// the compiler doesn't allow callable without naming them.
+type conversionChecker struct {
+	compiler   *Compiler
+	fset       *token.FileSet
+	info       *types.Info
+	candidates []types.Type
+	results    *types.Tuple
+	violations []Violation
+}
+
+// convert adds a violation if converting a value of the type from to the type to makes a method that is not allowed callable.
+func (self *conversionChecker) convert(node ast.Node, from, to types.Type) {
+	if p, name, problem, found := self.exposes(from, to); found {
+		self.violations = append(self.violations, Violation{
+			Pos:        self.fset.Position(node.Pos()),
+			Kind:       DisallowedSymbol,
+			ImportPath: p,
+			Message:    fmt.Sprintf("Conversion of %v to %v allows use of %v symbol %v.%v", from, to, problem, p, name),
+		})
+	}
+}
+
+// assert adds a violation if asserting an interface to the type to could make a method that is not allowed callable.
+func (self *conversionChecker) assert(node ast.Node, to types.Type) {
+	if to == nil || !types.IsInterface(to) {
+		return
+	}
+	for _, candidate := range self.candidates {
+		if p, name, problem, found := self.exposes(candidate, to); found {
+			self.violations = append(self.violations, Violation{
+				Pos:        self.fset.Position(node.Pos()),
+				Kind:       DisallowedSymbol,
+				ImportPath: p,
+				Message:    fmt.Sprintf("Type assertion to %v allows use of %v symbol %v.%v", to, problem, p, name),
+			})
+			return
+		}
+	}
+}
+
+// exposes returns the package, name and problem of a method of the type from that is not allowed, and that a value of the type from converted
+// to the interface type to makes callable, or false if there is none.
+func (self *conversionChecker) exposes(from, to types.Type) (p, name, problem string, found bool) {
+	if from == nil || to == nil || types.IsInterface(from) {
+		return "", "", "", false
+	}
+	if _, isTuple := from.(*types.Tuple); isTuple {
+		return "", "", "", false
+	}
+	iface, isInterface := to.Underlying().(*types.Interface)
+	if !isInterface || !types.Implements(from, iface) {
+		return "", "", "", false
+	}
+	for index := 0; index < iface.NumMethods(); index++ {
+		method := iface.Method(index)
+		obj, _, _ := types.LookupFieldOrMethod(from, true, method.Pkg(), method.Name())
+		if obj == nil {
+			continue
+		}
+		if p, name, ok := symbolName(obj); ok {
+			if problem, found := self.compiler.symbolProblem(p, name); found {
+				return p, name, problem, true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// assign calls convert for all values assigned to targets of the types in types.
+func (self *conversionChecker) assign(values []ast.Expr, targets []types.Type) {
+	if len(values) == 1 && len(targets) > 1 {
+		if tuple, isTuple := self.info.TypeOf(values[0]).(*types.Tuple); isTuple {
+			for index := 0; index < tuple.Len() && index < len(targets); index++ {
+				self.convert(values[0], tuple.At(index).Type(), targets[index])
+			}
+		}
+		return
+	}
+	for index := 0; index < len(values) && index < len(targets); index++ {
+		self.convert(values[index], self.info.TypeOf(values[index]), targets[index])
+	}
+}
+
+// typesOf returns the types of exprs.
+func (self *conversionChecker) typesOf(exprs []ast.Expr) (rval []types.Type) {
+	for _, expr := range exprs {
+		rval = append(rval, self.info.TypeOf(expr))
+	}
+	return rval
+}
+
+func (self *conversionChecker) Visit(node ast.Node) ast.Visitor {
+	switch node := node.(type) {
+	case *ast.FuncDecl:
+		if obj, ok := self.info.Defs[node.Name].(*types.Func); ok && node.Body != nil {
+			child := *self
+			child.results = obj.Type().(*types.Signature).Results()
+			ast.Walk(&child, node.Body)
+			self.violations = child.violations
+		}
+		return nil
+	case *ast.FuncLit:
+		if signature, ok := self.info.TypeOf(node).(*types.Signature); ok {
+			child := *self
+			child.results = signature.Results()
+			ast.Walk(&child, node.Body)
+			self.violations = child.violations
+		}
+		return nil
+	case *ast.ReturnStmt:
+		if self.results != nil {
+			var targets []types.Type
+			for index := 0; index < self.results.Len(); index++ {
+				targets = append(targets, self.results.At(index).Type())
+			}
+			self.assign(node.Results, targets)
+		}
+	case *ast.AssignStmt:
+		self.assign(node.Rhs, self.typesOf(node.Lhs))
+	case *ast.ValueSpec:
+		self.assign(node.Values, self.typesOf(identExprs(node.Names)))
+	case *ast.SendStmt:
+		if channel, ok := rangeType(self.info.TypeOf(node.Chan)).(*types.Chan); ok {
+			self.convert(node.Value, self.info.TypeOf(node.Value), channel.Elem())
+		}
+	case *ast.IndexExpr:
+		if m, ok := rangeType(self.info.TypeOf(node.X)).(*types.Map); ok {
+			self.convert(node.Index, self.info.TypeOf(node.Index), m.Key())
+		}
+	case *ast.RangeStmt:
+		if node.Tok == token.ASSIGN {
+			var key, value types.Type
+			switch collection := rangeType(self.info.TypeOf(node.X)).(type) {
+			case *types.Slice:
+				value = collection.Elem()
+			case *types.Array:
+				value = collection.Elem()
+			case *types.Map:
+				key, value = collection.Key(), collection.Elem()
+			case *types.Chan:
+				key = collection.Elem()
+			}
+			if node.Key != nil {
+				self.convert(node.Key, key, self.info.TypeOf(node.Key))
+			}
+			if node.Value != nil {
+				self.convert(node.Value, value, self.info.TypeOf(node.Value))
+			}
+		}
+	case *ast.CompositeLit:
+		switch typ := rangeType(self.info.TypeOf(node)).(type) {
+		case *types.Struct:
+			for index, element := range node.Elts {
+				if keyValue, ok := element.(*ast.KeyValueExpr); ok {
+					if key, ok := keyValue.Key.(*ast.Ident); !ok {
+						continue
+					} else if field, ok := self.info.ObjectOf(key).(*types.Var); ok {
+						self.convert(keyValue.Value, self.info.TypeOf(keyValue.Value), field.Type())
+					}
+				} else if index < typ.NumFields() {
+					self.convert(element, self.info.TypeOf(element), typ.Field(index).Type())
+				}
+			}
+		case *types.Slice, *types.Array, *types.Map:
+			var key, value types.Type
+			switch collection := typ.(type) {
+			case *types.Slice:
+				value = collection.Elem()
+			case *types.Array:
+				value = collection.Elem()
+			case *types.Map:
+				key, value = collection.Key(), collection.Elem()
+			}
+			for _, element := range node.Elts {
+				if keyValue, ok := element.(*ast.KeyValueExpr); ok {
+					if key != nil {
+						self.convert(keyValue.Key, self.info.TypeOf(keyValue.Key), key)
+					}
+					element = keyValue.Value
+				}
+				self.convert(element, self.info.TypeOf(element), value)
+			}
+		}
+	case *ast.TypeAssertExpr:
+		if node.Type != nil {
+			self.assert(node, self.info.TypeOf(node.Type))
+		}
+	case *ast.TypeSwitchStmt:
+		for _, statement := range node.Body.List {
+			for _, expr := range statement.(*ast.CaseClause).List {
+				self.assert(expr, self.info.TypeOf(expr))
+			}
+		}
+	case *ast.CallExpr:
+		if typeAndValue := self.info.Types[node.Fun]; typeAndValue.IsType() {
+			if len(node.Args) == 1 {
+				self.convert(node.Args[0], self.info.TypeOf(node.Args[0]), typeAndValue.Type)
+			}
+		} else if signature, ok := rangeType(typeAndValue.Type).(*types.Signature); ok {
+			var targets []types.Type
+			params := signature.Params()
+			for index := 0; index < params.Len(); index++ {
+				targets = append(targets, params.At(index).Type())
+			}
+			if signature.Variadic() && node.Ellipsis == token.NoPos && len(targets) > 0 {
+				variadic := targets[len(targets)-1]
+				targets = targets[:len(targets)-1]
+				values := len(node.Args)
+				if values == 1 {
+					values = tupleLen(self.info.TypeOf(node.Args[0]))
+				}
+				if slice, ok := variadic.Underlying().(*types.Slice); ok {
+					for len(targets) < values {
+						targets = append(targets, slice.Elem())
+					}
+				}
+			}
+			self.assign(node.Args, targets)
+		}
+	}
+	return self
+}
+
+// rangeType returns the underlying type of typ, or of what typ points to if it is a pointer, or nil if typ is nil.
+func rangeType(typ types.Type) types.Type {
+	if typ == nil {
+		return nil
+	}
+	if pointer, ok := typ.Underlying().(*types.Pointer); ok {
+		return pointer.Elem().Underlying()
+	}
+	return typ.Underlying()
+}
+
+// tupleLen returns the number of values of typ, if it is a tuple, or 1.
+func tupleLen(typ types.Type) int {
+	if tuple, ok := typ.(*types.Tuple); ok {
+		return tuple.Len()
+	}
+	return 1
+}
+
+// identExprs returns idents as expressions.
+func identExprs(idents []*ast.Ident) (rval []ast.Expr) {
+	for _, ident := range idents {
+		rval = append(rval, ident)
+	}
+	return rval
+}
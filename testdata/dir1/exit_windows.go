@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+func init() {
+	os.Exit(3)
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"strings"
+)
+
+func greeting() string {
+	return strings.Join([]string{"dir1", "go"}, ".")
+}
@@ -0,0 +1,11 @@
+//go:build ignore
+
+package main
+
+import (
+	"os"
+)
+
+func init() {
+	os.Exit(1)
+}
@@ -0,0 +1,11 @@
+//go:build loud
+
+package main
+
+import (
+	"os"
+)
+
+func init() {
+	os.Exit(2)
+}
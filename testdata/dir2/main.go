@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+)
+
+func add(a, b int) int
+
+func main() {
+	fmt.Print(add(1, 2))
+}
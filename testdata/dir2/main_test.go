@@ -0,0 +1,11 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	if add(1, 2) != 3 {
+		t.Error("1 + 2 should be 3")
+	}
+}
@@ -0,0 +1,9 @@
+package evil
+
+import (
+	"os/exec"
+)
+
+func Run() error {
+	return exec.Command("true").Run()
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+)
+
+func main() {
+	done := make(chan bool)
+	go func() {
+		fmt.Print("test10.go")
+		close(done)
+	}()
+	<-done
+}
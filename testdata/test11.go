@@ -0,0 +1,11 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+func main() {
+	err := &json.InvalidUnmarshalError{}
+	p := err.Type.Method(0).Func.UnsafePointer()
+	_ = (*[8]byte)(p)
+}
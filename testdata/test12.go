@@ -0,0 +1,11 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+func main() {
+	fmt.Print(json.Valid(nil), gob.NewEncoder(nil))
+}
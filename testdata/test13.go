@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Print("test13.go"
+	os.Exit(1))
+}
+
+func broken( {
+}
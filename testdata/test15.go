@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/zond/gosafe/child"
+)
+
+func spin(args ...interface{}) interface{} {
+	for {
+	}
+}
+
+func jump(args ...interface{}) interface{} {
+	n := 0
+loop:
+	n++
+	goto loop
+}
+
+func spawn(args ...interface{}) interface{} {
+	done := make(chan bool)
+	go func() {
+		for {
+		}
+	}()
+	<-done
+	return nil
+}
+
+var wake chan bool
+var woke chan bool
+
+func leak(args ...interface{}) interface{} {
+	wake = make(chan bool)
+	woke = make(chan bool)
+	go func() {
+		<-wake
+		woke <- true
+		for {
+		}
+	}()
+	return nil
+}
+
+func count(args ...interface{}) interface{} {
+	if wake != nil {
+		close(wake)
+		<-woke
+	}
+	n := 0.0
+	for n < args[0].(float64) {
+		n++
+	}
+	return n
+}
+
+func sum(args ...interface{}) interface{} {
+	rval := 0.0
+	for _, arg := range args {
+		rval += arg.(float64)
+	}
+	return rval
+}
+
+func main() {
+	child.NewServer().Register("spin", spin).Register("jump", jump).Register("sum", sum).Register("spawn", spawn).Register("leak", leak).Register("count", count).Start()
+}
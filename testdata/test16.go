@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+)
+
+func main() {
+	fmt.Printf("%d\n", "test16.go")
+	return
+	fmt.Println("unreachable")
+}
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+var version = "unset"
+
+func main() {
+	for range 1 {
+		fmt.Print(version)
+	}
+}
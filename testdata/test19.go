@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type setter interface {
+	SetInt(int64)
+}
+
+func set[T setter](t T) {
+	t.SetInt(2)
+}
+
+func main() {
+	v := reflect.ValueOf(new(int)).Elem()
+	var s interface{ SetInt(int64) } = v
+	s.SetInt(1)
+	var a any = v
+	a.(setter).SetInt(3)
+	set(v)
+	fmt.Println(v.Int())
+}
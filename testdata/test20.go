@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"gosafe.test/asm"
+)
+
+func main() {
+	fmt.Print(asm.Add(1, 2))
+}
@@ -10,7 +10,7 @@
 package main
 
 import (
-	child "../child"
+	child "github.com/zond/gosafe/child"
 )
 
 func main() {
@@ -1,7 +1,7 @@
 package main
 
 import (
-	child "../child"
+	child "github.com/zond/gosafe/child"
 	"math/rand"
 	"time"
 	"fmt"
@@ -1,7 +1,7 @@
 package main
 
 import (
-	child "../child"
+	child "github.com/zond/gosafe/child"
 )
 
 func sin(args... interface{}) interface{} {
@@ -0,0 +1,16 @@
+//go:build linux || !linux
+
+package main
+
+import (
+	"fmt"
+	_ "unsafe"
+)
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+//go:noinline
+func main() {
+	fmt.Println(nanotime())
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"fmt"
+	sys "os"
+	. "reflect"
+)
+
+func main() {
+	v := ValueOf(new(int)).Elem()
+	v.SetInt(int64(len(sys.Getenv("HOME"))))
+	fmt.Println(v.Int(), sys.Args)
+}
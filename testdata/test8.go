@@ -0,0 +1,9 @@
+package main
+
+import (
+	"gosafe.test/evil"
+)
+
+func main() {
+	evil.Run()
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	var n int = "one"
+	fmt.Print(n, os.Args)
+}
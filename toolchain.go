@@ -0,0 +1,72 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/version"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// MinToolchainVersion is the oldest go toolchain Compilers can build code with.
+const MinToolchainVersion = "go1.21"
+
+// goBinary returns the path of the go binary of the Toolchain of this gosafe.Compiler.
+func (self *Compiler) goBinary() (string, error) {
+	if self.Toolchain == "" {
+		return exec.LookPath("go")
+	}
+	binary := self.Toolchain
+	if info, err := os.Stat(binary); err != nil {
+		return "", Error(fmt.Sprintf("Toolchain %q not found: %v", self.Toolchain, err))
+	} else if info.IsDir() {
+		binary = filepath.Join(binary, "bin", "go")
+		if runtime.GOOS == "windows" {
+			binary += ".exe"
+		}
+	}
+	info, err := os.Stat(binary)
+	if err != nil || info.IsDir() {
+		return "", Error(fmt.Sprintf("Toolchain %q has no go binary", self.Toolchain))
+	}
+	return binary, nil
+}
+
+// toolchainVersion returns the full version of the Toolchain of this gosafe.Compiler, like "go1.21.3", asking the toolchain unless ctx is done.
+// Returns an error if the toolchain is older than MinToolchainVersion.
+func (self *Compiler) toolchainVersion(ctx context.Context) (string, error) {
+	self.cacheLock.Lock()
+	if self.version != "" && self.versionToolchain == self.Toolchain {
+		defer self.cacheLock.Unlock()
+		return self.version, nil
+	}
+	self.cacheLock.Unlock()
+	toolchain := self.Toolchain
+	env, err := self.buildEnv(BuildOptions{})
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	if err = self.runGo(ctx, os.TempDir(), env, &stdout, &stderr, "env", "GOVERSION"); err != nil {
+		if stderr.Len() > 0 && !errors.Is(err, ErrCompileLimit) && ctx.Err() == nil {
+			return "", Error(stderr.String())
+		}
+		return "", err
+	}
+	toolchainVersion := strings.TrimSpace(stdout.String())
+	// Development versions, like "devel go1.22-d0f7a19e5c", are not checked
+	if toolchainVersion == "" || version.IsValid(toolchainVersion) && version.Compare(toolchainVersion, MinToolchainVersion) < 0 {
+		return "", Error(fmt.Sprintf("Toolchain %q has version %q, older than %v", toolchain, toolchainVersion, MinToolchainVersion))
+	}
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	self.version = toolchainVersion
+	self.versionToolchain = toolchain
+	return toolchainVersion, nil
+}
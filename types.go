@@ -0,0 +1,228 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// exportedPackage is the subset of the `go list -export -json` output used when type checking.
+type exportedPackage struct {
+	ImportPath string
+	Export     string
+	Error      *struct {
+		Err string
+	}
+}
+
+// exportImporter imports packages from the export data the go toolchain of a gosafe.Compiler produced for them, and keeps them to be imported
+// again by later type checks.
+type exportImporter struct {
+	// lock guards everything below, since type checks may run concurrently
+	lock     sync.Mutex
+	importer types.Importer
+	// the export data files, by import path
+	exports map[string]string
+	// the errors listing packages, by import path
+	errors map[string]string
+}
+
+func newExportImporter() *exportImporter {
+	rval := &exportImporter{
+		exports: make(map[string]string),
+		errors:  make(map[string]string),
+	}
+	rval.importer = importer.ForCompiler(token.NewFileSet(), "gc", rval.lookup)
+	return rval
+}
+
+func (self *exportImporter) Import(p string) (*types.Package, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if message, found := self.errors[p]; found {
+		return nil, Error(message)
+	}
+	return self.importer.Import(p)
+}
+
+// lookup opens the export data of p. Only called by the importer, with the lock held.
+func (self *exportImporter) lookup(p string) (io.ReadCloser, error) {
+	export, found := self.exports[p]
+	if !found || export == "" {
+		return nil, Error(fmt.Sprintf("No export data for %q", p))
+	}
+	return os.Open(export)
+}
+
+// missing returns the packages of roots that haven't been listed yet.
+func (self *exportImporter) missing(roots []string) (rval []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, p := range roots {
+		_, exported := self.exports[p]
+		_, failed := self.errors[p]
+		if !exported && !failed {
+			rval = append(rval, p)
+		}
+	}
+	return rval
+}
+
+// add adds the listed packages.
+func (self *exportImporter) add(listed []exportedPackage) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, pkg := range listed {
+		if pkg.Error != nil {
+			self.errors[pkg.ImportPath] = pkg.Error.Err
+		}
+		self.exports[pkg.ImportPath] = pkg.Export
+	}
+}
+
+// newImporter returns an importer for the packages imported by files, and everything they import, as built by the toolchain of this
+// gosafe.Compiler for its platform and BuildOptions in a throwaway module where all replaced packages are available.
+// Packages this gosafe.Compiler doesn't allow importing are left out. The export data is reused until the toolchain, platform, BuildOptions or
+// replaced packages change, so the toolchain only runs for packages not imported by earlier checks.
+func (self *Compiler) newImporter(ctx context.Context, files []*ast.File) (*exportImporter, error) {
+	key, err := self.importKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	self.cacheLock.Lock()
+	if self.imports == nil || self.importsKey != key {
+		self.imports = newExportImporter()
+		self.importsKey = key
+	}
+	rval := self.imports
+	self.cacheLock.Unlock()
+	roots := make(map[string]bool)
+	for _, file := range files {
+		for _, spec := range file.Imports {
+			if p, err := strconv.Unquote(spec.Path.Value); err == nil && p != "C" && p != "unsafe" && self.importAllowed(p) {
+				roots[p] = true
+			}
+		}
+	}
+	missing := rval.missing(sortedKeys(roots))
+	if len(missing) == 0 {
+		return rval, nil
+	}
+	listed, err := self.listExports(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	rval.add(listed)
+	return rval, nil
+}
+
+// listExports returns the packages roots, and everything they import, with their export data built by `go list -export` in a throwaway module.
+func (self *Compiler) listExports(ctx context.Context, roots []string) (rval []exportedPackage, err error) {
+	dir, root, err := self.newModule(ctx, nil, nil, false, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+	env, err := self.buildEnv(self.BuildOptions)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	// -e since missing packages are type errors in the checked code
+	args := append([]string{"list", "-e", "-export", "-deps", "-json=ImportPath,Export,Error"}, self.BuildOptions.args()...)
+	if err = self.runGo(ctx, dir, env, &stdout, &stderr, append(args, roots...)...); err != nil {
+		if stderr.Len() > 0 && !errors.Is(err, ErrCompileLimit) && ctx.Err() == nil {
+			return nil, Error(stderr.String())
+		}
+		return nil, err
+	}
+	decoder := json.NewDecoder(&stdout)
+	for {
+		var pkg exportedPackage
+		if err = decoder.Decode(&pkg); err == io.EOF {
+			return rval, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rval = append(rval, pkg)
+	}
+}
+
+// restrictedImporter imports packages for the checked code, refusing packages it isn't allowed to import.
+type restrictedImporter struct {
+	compiler *Compiler
+	importer types.Importer
+}
+
+func (self restrictedImporter) Import(p string) (*types.Package, error) {
+	if !self.compiler.importAllowed(p) {
+		return nil, Error(fmt.Sprintf("Import of disallowed library %q", p))
+	}
+	if p == "unsafe" {
+		return types.Unsafe, nil
+	}
+	return self.importer.Import(p)
+}
+
+// typeCheck type checks files, with the packages they import resolved by the go toolchain, and returns the resulting package and type
+// information along with violations for all type errors, and the type errors themselves. Errors caused by disallowed imports are left out,
+// since they are violations already.
+func (self *Compiler) typeCheck(ctx context.Context, fset *token.FileSet, files []*ast.File) (pkg *types.Package, info *types.Info, violations []Violation, typeErrors []types.Error, err error) {
+	imports, err := self.newImporter(ctx, files)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	disallowedImports := make(map[token.Pos]bool)
+	for _, file := range files {
+		for _, spec := range file.Imports {
+			if importPath, err := strconv.Unquote(spec.Path.Value); err == nil && importPath != "C" && !self.importAllowed(importPath) {
+				disallowedImports[spec.Path.Pos()] = true
+			}
+		}
+	}
+	info = &types.Info{
+		Types:        make(map[ast.Expr]types.TypeAndValue),
+		Instances:    make(map[*ast.Ident]types.Instance),
+		Defs:         make(map[*ast.Ident]types.Object),
+		Uses:         make(map[*ast.Ident]types.Object),
+		Implicits:    make(map[ast.Node]types.Object),
+		Selections:   make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:       make(map[ast.Node]*types.Scope),
+		FileVersions: make(map[*ast.File]string),
+	}
+	config := &types.Config{
+		Importer:    restrictedImporter{compiler: self, importer: imports},
+		Sizes:       types.SizesFor("gc", self.GOARCH),
+		FakeImportC: true,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok {
+				if !disallowedImports[typeErr.Pos] {
+					typeErrors = append(typeErrors, typeErr)
+					violations = append(violations, Violation{
+						Pos:     typeErr.Fset.Position(typeErr.Pos),
+						Kind:    TypeError,
+						Message: typeErr.Msg,
+					})
+				}
+			} else {
+				violations = append(violations, Violation{
+					Kind:    TypeError,
+					Message: err.Error(),
+				})
+			}
+		},
+	}
+	pkg, _ = config.Check(files[0].Name.Name, fset, files, info)
+	return pkg, info, violations, typeErrors, nil
+}
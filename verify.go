@@ -0,0 +1,179 @@
+package gosafe
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/gosym"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbolPackage returns the import path of the package the symbol name belongs to, or the empty string for symbols generated by the compiler
+// or linker, like Package.Name does in debug/gosym.
+func symbolPackage(name string) string {
+	if strings.HasPrefix(name, "go:") || strings.HasPrefix(name, "type:") {
+		return ""
+	}
+	if index := strings.Index(name, "["); index != -1 {
+		name = name[:index]
+	}
+	end := strings.LastIndex(name, "/")
+	if end < 0 {
+		end = 0
+	}
+	if index := strings.Index(name[end:], "."); index != -1 {
+		return name[:end+index]
+	}
+	return ""
+}
+
+// linkable returns the import paths of all packages a program built by this gosafe.Compiler in the throwaway module dir, with the environment
+// env, may link: the packages allowed, trusted or with allowed symbols, and their transitive import closure, including the runtime.
+func (self *Compiler) linkable(ctx context.Context, dir string, env []string) (map[string]bool, error) {
+	roots := []string{"runtime"}
+	if self.Gas > 0 {
+		roots = append(roots, ChildPackage)
+	}
+	for _, patterns := range []map[string]bool{self.allowed, self.trusted} {
+		for quoted, _ := range patterns {
+			if pattern, err := strconv.Unquote(quoted); err == nil && pattern != "C" {
+				roots = append(roots, pattern)
+			}
+		}
+	}
+	for p, _ := range self.allowedSymbols {
+		roots = append(roots, p)
+	}
+	sort.Strings(roots)
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	// -e since allowed packages don't have to exist
+	if err := self.runGo(ctx, dir, env, &stdout, &stderr, append([]string{"list", "-e", "-deps", "-f", "{{.ImportPath}}"}, roots...)...); err != nil {
+		if stderr.Len() > 0 && !errors.Is(err, ErrCompileLimit) && ctx.Err() == nil {
+			return nil, Error(stderr.String())
+		}
+		return nil, err
+	}
+	rval := map[string]bool{"main": true}
+	for _, p := range strings.Fields(stdout.String()) {
+		rval[p] = true
+	}
+	return rval, nil
+}
+
+// linkableFile returns whether file is in the directory of one of the packages in linkable, like the functions the runtime defines in
+// other packages.
+func linkableFile(linkable map[string]bool, file string) bool {
+	dir := filepath.ToSlash(filepath.Dir(file))
+	for {
+		if linkable[dir] {
+			return true
+		}
+		index := strings.Index(dir, "/")
+		if index == -1 {
+			return false
+		}
+		dir = dir[index+1:]
+	}
+}
+
+// verifyBinary returns a *CheckError if the binary built by this gosafe.Compiler in the throwaway module dir, with the environment env, is
+// dynamically linked, uses cgo, depends on modules that are not replaced packages, or contains code from packages that may not be linked
+// according to linkable.
+func (self *Compiler) verifyBinary(ctx context.Context, binary, dir string, env []string) error {
+	info, err := buildinfo.ReadFile(binary)
+	if err != nil {
+		return err
+	}
+	file, err := elf.Open(binary)
+	if err != nil {
+		return Error(fmt.Sprintf("VerifyBinary requires ELF binaries: %v", err))
+	}
+	defer file.Close()
+	var violations []Violation
+	violation := func(p, message string) {
+		violations = append(violations, Violation{
+			Kind:       DisallowedLinkage,
+			ImportPath: p,
+			Message:    message,
+		})
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "CGO_ENABLED" && setting.Value == "1" {
+			violation("", "Binary built with cgo")
+		}
+	}
+	for _, dep := range info.Deps {
+		if _, found := self.replaced[dep.Path]; !found {
+			violation(dep.Path, fmt.Sprintf("Binary depends on module %q, which is not a replaced package", dep.Path))
+		}
+	}
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP || prog.Type == elf.PT_DYNAMIC {
+			violation("", "Binary is dynamically linked")
+			break
+		}
+	}
+	linkable, err := self.linkable(ctx, dir, env)
+	if err != nil {
+		return err
+	}
+	pclntab := file.Section(".gopclntab")
+	text := file.Section(".text")
+	if pclntab == nil || text == nil {
+		return Error("Binary has no Go line table")
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return err
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return err
+	}
+	linked := make(map[string]bool)
+	functions := make(map[string]bool)
+	for _, function := range table.Funcs {
+		functions[function.Name] = true
+		p := symbolPackage(function.Name)
+		if p == "" || linked[p] || (linkable[p] && p != "runtime/cgo") {
+			continue
+		}
+		if fileName, _, _ := table.PCToLine(function.Entry); p != "runtime/cgo" && linkableFile(linkable, fileName) {
+			continue
+		}
+		linked[p] = true
+	}
+	// The symbol table is missing in binaries linked with -s, but when present it also contains functions without Go line tables
+	symbols, err := file.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return err
+	}
+	for _, symbol := range symbols {
+		if p := symbolPackage(symbol.Name); p != "" && elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && !functions[symbol.Name] && !linkable[p] {
+			linked[p] = true
+		}
+	}
+	if linked["runtime/cgo"] {
+		violation("runtime/cgo", "Binary contains cgo")
+		delete(linked, "runtime/cgo")
+	}
+	var paths []string
+	for p, _ := range linked {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		violation(p, fmt.Sprintf("Binary contains code from disallowed library %q", p))
+	}
+	if len(violations) > 0 {
+		return &CheckError{Violations: violations}
+	}
+	return nil
+}